@@ -18,6 +18,10 @@ var (
 	consoleOutputChan = make(chan string, 16)       // console output channel
 	debugOutputChan = make(chan string, 16)         // console output channel
 	debugCommandChan = make(chan []string, 16)      // debug command channel
+	debugAbortChan = make(chan bool, 1)             // abort job channel (non-blocking)
+	watchOutputChan = make(chan *watchPane, 4)      // watch pane channel
+	memeditInputChan = make(chan memeditInput, 16)  // memory editor key channel
+	memeditOutputChan = make(chan *memeditScreen, 4) // memory editor pane channel
 	quitChan = make(chan string, 3)                 // quit channel (non-blocking)
 	consoleIoServicer consoleIoServicerFunc         // Console I/O servicer routine
 	debugInterface debugInterfaceFunc               // Debug I/O servicer routine
@@ -30,44 +34,63 @@ func init() {
 		"Neon816 Integrated Console -",
 		fmt.Sprintf("nico v%s by Michael Guidero", VERSION))
 	flag.Usage = func() {
-		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s <console-device> [<debug-device>]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [<console-device> [<debug-device>]]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s sim <socket>\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s bench [<bytes>]\n", os.Args[0])
 		flag.PrintDefaults()
 	}
 	flag.UintVar(&consoleSpeed, "console-baud", 9600, "Set console baud")
 	flag.UintVar(&debugSpeed, "debug-baud", 57600, "Set console baud")
+	flag.IntVar(&debugChunk, "debug-chunk", debugChunk, "Characters written to debug port at once")
+	flag.IntVar(&debugReadWindow, "debug-window", debugReadWindow, "Reads in flight on debug port at once")
+	flag.IntVar(&debugRetries, "debug-retries", debugRetries, "Times to retry debug port reads after errors")
+	flag.BoolVar(&debugFrame, "debug-frame", false, "Frame debug port reads with reads of the MMU registers")
 	flag.BoolVar(&noDebug, "no-debug", false, "Disable debug/command interface")
-	flag.Parse()
+	flag.StringVar(&simChipName, "sim-chip", simChipName, "Flash ROM part for sim")
+	flag.UintVar(&simBaud, "sim-baud", 0, "Debug port speed for sim to model")
+	flag.IntVar(&simRxBuf, "sim-rxbuf", simRxBuf, "Receive buffer size for sim to model")
+	flag.DurationVar(&simLatency, "sim-latency", 0, "Debug port round trip time for sim to model")
 }
 
 // Get everything set up
 func main() {
+	flag.Parse()
+	if flag.Arg(0) == "sim" {
+		// Debug port simulator, no UI
+		log.Fatal(runSimulator(flag.Arg(1)))
+	}
+	if flag.Arg(0) == "bench" {
+		// Debug port write benchmark against the simulator, no UI
+		if err := runBenchmark(flag.Arg(1)); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	testMode := false
-	debugInterface = nullDebugInterface
-	if consoleDevice := flag.Arg(0); consoleDevice != "" {
-		if consoleDevice == "test" {
-			testMode = true
-			consoleIoServicer = demoConsoleIoServicer
-			consoleOutputChan <- "*** Test Mode ***\r\n"
-		} else {
+	if consoleDevice := flag.Arg(0); consoleDevice == "test" {
+		testMode = true
+		consoleIoServicer = demoConsoleIoServicer
+		consoleOutputChan <- "*** Test Mode ***\r\n"
+	} else if consoleDevice != "" || !noDebug {
+		// without a device, connect console connects one later
+		if consoleDevice != "" {
 			log.Printf("Console device: %s", consoleDevice)
-			consoleIoServicer = getConsoleIoServicer(consoleDevice)
 		}
+		consoleIoServicer = getConsoleIoServicer(consoleDevice)
 	}
 	if consoleIoServicer == nil {
 		log.Fatal("Invalid or no console device specified!")
 	}
 	if noDebug {
 		debugInterface = noDebugInterface
+	} else if testMode {
+		debugInterface = getDebugInterface("")
 	} else {
-		if debugDevice := flag.Arg(1); debugDevice != "" {
+		debugDevice := flag.Arg(1)
+		if debugDevice != "" {
 			log.Printf("Debug device: %s", debugDevice)
-			debugInterface = getDebugInterface(debugDevice)
-			if debugInterface == nil {
-				debugInterface = nullDebugInterface
-				log.Print("Debug device is not usable")
-				debugOutputChan <- fmt.Sprintf("Debug device %s is not usable!\n", debugDevice)
-			}
 		}
+		debugInterface = getDebugInterface(debugDevice)
 	}
 	src, err := goncurses.Init()
 	if err != nil {
@@ -128,11 +151,17 @@ func mainApp() {
 	select {
 	case exitReason = <-quitChan:
 	}
+	// stops anything started with exec:
+	if consoleConn != nil {
+		consoleConn.disconnect()
+	}
+	debugConn.disconnect()
 }
 
 // Sets up the Curses windows
 func winSetup(src *goncurses.Window) {
 	ysize, xsize := src.MaxYX()
+	rootWindow = src
 	if noDebug {
 		consoleWindow = src
 	} else {
@@ -0,0 +1,179 @@
+package main
+
+// 65816 line assembler
+
+import (
+	"fmt"
+	"strings"
+)
+
+// An operand form, the text around the value and the modes it can be
+// assembled as, smallest first
+type asmPattern struct {
+	prefix, suffix string
+	modes          []addrMode
+}
+
+// Operand forms, in the order they are tried
+var asmPatterns = []asmPattern{
+	{"#", "", []addrMode{modeImmM, modeImmX, modeImm8}},
+	{"(", ",S),Y", []addrMode{modeSrIndY}},
+	{"(", ",X)", []addrMode{modeDpIndX, modeAbsIndX}},
+	{"(", "),Y", []addrMode{modeDpIndY}},
+	{"(", ")", []addrMode{modeDpInd, modeAbsInd}},
+	{"[", "],Y", []addrMode{modeDpIndLY}},
+	{"[", "]", []addrMode{modeDpIndL, modeAbsIndL}},
+	{"", ",S", []addrMode{modeSr}},
+	{"", ",X", []addrMode{modeDpX, modeAbsX, modeLongX}},
+	{"", ",Y", []addrMode{modeDpY, modeAbsY}},
+	{"", "", []addrMode{modeRel, modeRelL, modeDp, modeAbs, modeLong, modeImm8}},
+}
+
+// Return the opcode for an instruction, if there is one
+func findOpcode(mnem string, mode addrMode) (byte, bool) {
+	for i, op := range opcodes {
+		if op.mnem == mnem && op.mode == mode {
+			return byte(i), true
+		}
+	}
+	return 0, false
+}
+
+// Parse an assembler value, returning it and the number of bytes it was
+// written with (see evalExprSized)
+func parseAsmValue(s string) (uint32, int, error) {
+	v, size, err := evalExprSized(s)
+	if err != nil {
+		return 0, 0, err
+	}
+	if v < 0 || v > 0xFF_FFFF {
+		return 0, 0, fmt.Errorf("value out of range")
+	}
+	return uint32(v), size, nil
+}
+
+// Assemble one instruction at addr for the register widths w
+func assemble(addr uint32, line string, w cpuWidths) ([]byte, error) {
+	if i := strings.Index(line, ";"); i >= 0 {
+		line = line[:i] // comment
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("nothing to assemble")
+	}
+	// operand keeps its case for symbols, uop is for matching the syntax
+	mnem, operand := strings.ToUpper(fields[0]), strings.Join(fields[1:], "")
+	uop := strings.ToUpper(operand)
+	known := false
+	for _, op := range opcodes {
+		known = known || op.mnem == mnem
+	}
+	if !known {
+		return nil, fmt.Errorf("unknown instruction %s", mnem)
+	}
+	// Operands that aren't a single value
+	if operand == "" || uop == "A" {
+		if code, ok := findOpcode(mnem, modeAcc); ok {
+			return []byte{code}, nil
+		}
+	}
+	if operand == "" {
+		if code, ok := findOpcode(mnem, modeImp); ok {
+			return []byte{code}, nil
+		}
+		if code, ok := findOpcode(mnem, modeImm8); ok {
+			// BRK or COP with no signature byte
+			return []byte{code, 0}, nil
+		}
+		return nil, fmt.Errorf("%s needs an operand", mnem)
+	}
+	if code, ok := findOpcode(mnem, modeBlk); ok {
+		banks := strings.Split(operand, ",")
+		if len(banks) != 2 {
+			return nil, fmt.Errorf("%s needs source and destination banks", mnem)
+		}
+		src, _, err := parseAsmValue(banks[0])
+		if err != nil {
+			return nil, err
+		}
+		dst, _, err := parseAsmValue(banks[1])
+		if err != nil {
+			return nil, err
+		}
+		if src > 0xFF || dst > 0xFF {
+			return nil, fmt.Errorf("bank out of range")
+		}
+		return []byte{code, byte(dst), byte(src)}, nil
+	}
+	for _, p := range asmPatterns {
+		if !strings.HasPrefix(uop, p.prefix) || !strings.HasSuffix(uop, p.suffix) ||
+			len(operand) <= len(p.prefix)+len(p.suffix) {
+			continue
+		}
+		if p.prefix == "" && uop[0] == '#' {
+			// immediate, but the instruction has no immediate mode
+			continue
+		}
+		var modes []addrMode
+		for _, mode := range p.modes {
+			if _, ok := findOpcode(mnem, mode); ok {
+				modes = append(modes, mode)
+			}
+		}
+		if len(modes) == 0 {
+			continue
+		}
+		text := operand[len(p.prefix) : len(operand)-len(p.suffix)]
+		value, size, err := parseAsmValue(text)
+		if err != nil {
+			return nil, err
+		}
+		for _, mode := range modes {
+			if data, ok := asmOperand(addr, mode, value, size, w); ok {
+				code, _ := findOpcode(mnem, mode)
+				return append([]byte{code}, data...), nil
+			}
+		}
+		return nil, fmt.Errorf("operand out of range")
+	}
+	return nil, fmt.Errorf("bad addressing mode for %s", mnem)
+}
+
+// Encode the operand for mode, if value fits it
+func asmOperand(addr uint32, mode addrMode, value uint32, size int, w cpuWidths) ([]byte, bool) {
+	n := mode.operandSize(w)
+	switch mode {
+	case modeRel:
+		// branches stay within the bank
+		if value>>16 != 0 && value>>16 != addr>>16 {
+			return nil, false
+		}
+		off := int16(value - (addr + 2))
+		if off < -128 || off > 127 {
+			return nil, false
+		}
+		value = uint32(off)
+	case modeRelL:
+		if value>>16 != 0 && value>>16 != addr>>16 {
+			return nil, false
+		}
+		value -= addr + 3
+	case modeImmM, modeImmX, modeImm8:
+		if value>>(8*uint(n)) != 0 {
+			return nil, false
+		}
+	default:
+		if size == 0 && n == 2 && value>>16 == addr>>16 {
+			// symbols in the current bank can be absolute addresses
+			value &= 0xFFFF
+		}
+		if size > n || value>>(8*uint(n)) != 0 {
+			return nil, false
+		}
+	}
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(value >> (8 * uint(i)))
+	}
+	return data, true
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAssemble(t *testing.T) {
+	m16 := cpuWidths{x8: true, carry: -1}
+	tests := []struct {
+		addr uint32
+		line string
+		w    cpuWidths
+		want []byte
+	}{
+		{0x1000, "nop", defaultWidths(), []byte{0xEA}},
+		{0x1000, "ASL", defaultWidths(), []byte{0x0A}},
+		{0x1000, "asl a  ; shift", defaultWidths(), []byte{0x0A}},
+		{0x1000, "BRK", defaultWidths(), []byte{0x00, 0x00}},
+		{0x1000, "LDA #$12", defaultWidths(), []byte{0xA9, 0x12}},
+		{0x1000, "LDA #$1234", m16, []byte{0xA9, 0x34, 0x12}},
+		{0x1000, "LDA $12", defaultWidths(), []byte{0xA5, 0x12}},
+		{0x1000, "LDA $0012", defaultWidths(), []byte{0xAD, 0x12, 0x00}},
+		{0x1000, "LDA $000012", defaultWidths(), []byte{0xAF, 0x12, 0x00, 0x00}},
+		{0x1000, "LDA $12,x", defaultWidths(), []byte{0xB5, 0x12}},
+		{0x1000, "LDA ($12),Y", defaultWidths(), []byte{0xB1, 0x12}},
+		{0x1000, "LDA ( $12 , S ) , Y", defaultWidths(), []byte{0xB3, 0x12}},
+		{0x1000, "LDA [$12]", defaultWidths(), []byte{0xA7, 0x12}},
+		{0x1000, "JMP ($1234)", defaultWidths(), []byte{0x6C, 0x34, 0x12}},
+		{0x1000, "JML [$1234]", defaultWidths(), []byte{0xDC, 0x34, 0x12}},
+		{0x1000, "JSL $12:3456", defaultWidths(), []byte{0x22, 0x56, 0x34, 0x12}},
+		{0x1000, "BNE $1000", defaultWidths(), []byte{0xD0, 0xFE}},
+		{0x1000, "BRL $1000", defaultWidths(), []byte{0x82, 0xFD, 0xFF}},
+		{0x1000, "MVN $12,$34", defaultWidths(), []byte{0x54, 0x34, 0x12}},
+		{0x1000, "PEA $1234", defaultWidths(), []byte{0xF4, 0x34, 0x12}},
+		{0x1000, "REP #$30", defaultWidths(), []byte{0xC2, 0x30}},
+	}
+	for _, tt := range tests {
+		got, err := assemble(tt.addr, tt.line, tt.w)
+		if err != nil {
+			t.Errorf("%q: %v", tt.line, err)
+			continue
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%q: got % X, want % X", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestAssembleErrors(t *testing.T) {
+	tests := []struct {
+		line string
+		err  string
+	}{
+		{"", "nothing to assemble"},
+		{"; just a comment", "nothing to assemble"},
+		{"FOO $12", "unknown instruction FOO"},
+		{"LDA", "LDA needs an operand"},
+		{"LDA #$123", "operand out of range"},
+		{"BNE $2000", "operand out of range"},
+		{"STA #$12", "bad addressing mode for STA"},
+		{"MVN $12", "MVN needs source and destination banks"},
+		{"MVN $123,$12", "bank out of range"},
+	}
+	for _, tt := range tests {
+		if _, err := assemble(0x1000, tt.line, defaultWidths()); err == nil || err.Error() != tt.err {
+			t.Errorf("%q: error %v, want %s", tt.line, err, tt.err)
+		}
+	}
+}
+
+// Every instruction the disassembler shows should assemble back to the same
+// code
+func TestAssembleRoundTrip(t *testing.T) {
+	saved := symbols
+	defer func() { symbols = saved }()
+	symbols = newSymbolTable()
+	const addr = 0x12_3400
+	for op := 0; op < 256; op++ {
+		for _, w := range []cpuWidths{defaultWidths(), {carry: -1}} {
+			code := []byte{byte(op), 0x56, 0x34, 0x12}
+			dw := w
+			text, n := disassemble(addr, code, &dw)
+			got, err := assemble(addr, text, w)
+			if err != nil {
+				t.Errorf("%02X %q (%v): %v", op, text, w, err)
+				continue
+			}
+			if !bytes.Equal(got, code[:n]) {
+				t.Errorf("%02X %q (%v): assembled % X, want % X", op, text, w, got, code[:n])
+			}
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+// Debug port benchmark
+
+// "nico bench" writes memory in the simulator over a Unix domain socket, as
+// program does, with different -debug-chunk sizes, checking what lands in
+// the simulator's memory, then reads it back as verify does with different
+// -debug-window sizes.  The simulator takes characters in no faster than
+// -debug-baud would carry them, loses any that don't fit its -sim-rxbuf
+// receive buffer and holds replies back for -sim-latency, so this shows how
+// much time each size saves and which ones would overrun the Neon.
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Where the benchmark writes
+const benchAddr = 0x80_0000
+
+// Chunk and window sizes to try
+var (
+	benchChunks  = []int{1, 8, 16, 32, 64, 128}
+	benchWindows = []int{1, 4, 16, 32, 64, 128}
+)
+
+// Run the benchmark, writing size bytes (default 4K) each time
+func runBenchmark(size string) error {
+	n := 0x1000
+	if size != "" {
+		v, err := evalExpr(size)
+		if err != nil || v < 1 || v > 0x10000 {
+			return fmt.Errorf("bad size %s, 1 to 64K bytes", size)
+		}
+		n = int(v)
+	}
+	chip := findFlashChipByName(simChipName)
+	if chip == nil {
+		return fmt.Errorf("unknown flash chip %s", simChipName)
+	}
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("nico-bench-%v.sock", os.Getpid()))
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	defer l.Close()
+	s := newNeonSim(chip)
+	s.baud, s.rxBuf, s.latency = debugSpeed, simRxBuf, simLatency
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i*7 + i>>8)
+	}
+	log.Printf("Writing %v bytes at %v baud, %v character receive buffer, %v round trip",
+		n, debugSpeed, simRxBuf, simLatency)
+	for _, chunk := range benchChunks {
+		c, err := net.Dial("unix", path)
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		copy(s.ram[benchAddr:], make([]byte, n))
+		lost := s.overrun
+		s.mu.Unlock()
+		t := newNeonTarget(c, debugSpeed)
+		t.chunk = chunk
+		start := time.Now()
+		err = t.WriteMemory(benchAddr, data)
+		elapsed := time.Since(start)
+		if err != nil {
+			c.Close()
+			return err
+		}
+		// a read can't be answered until the simulator has taken everything
+		// written before it
+		_, err = t.ReadMemory(benchAddr, 1)
+		c.Close()
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		got := append([]byte(nil), s.ram[benchAddr:benchAddr+n]...)
+		s.mu.Unlock()
+		benchReport("write chunk", chunk, elapsed, data, got, s.overrun-lost)
+	}
+	for _, window := range benchWindows {
+		c, err := net.Dial("unix", path)
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		copy(s.ram[benchAddr:], data)
+		lost := s.overrun
+		s.mu.Unlock()
+		t := newNeonTarget(c, debugSpeed)
+		t.window = window
+		start := time.Now()
+		got, err := t.ReadMemory(benchAddr, n)
+		elapsed := time.Since(start)
+		c.Close()
+		if err != nil {
+			log.Printf("read window %3v: %v", window, err)
+			continue
+		}
+		benchReport("read window", window, elapsed, data, got, s.overrun-lost)
+	}
+	return nil
+}
+
+// Report how one run went
+func benchReport(what string, size int, elapsed time.Duration, data, got []byte, lost int) {
+	bad := 0
+	for i := range data {
+		if got[i] != data[i] {
+			bad++
+		}
+	}
+	log.Printf("%s %3v: %8v, %6.0f bytes/s, %v characters lost, %v bad bytes",
+		what, size, elapsed.Round(time.Millisecond), float64(len(data))/elapsed.Seconds(), lost, bad)
+}
@@ -0,0 +1,324 @@
+package main
+
+// Software breakpoints
+
+// A breakpoint replaces the byte at its address with BRK.  The native mode
+// BRK vector is pointed at a small handler in bank 0 RAM which saves the
+// registers on the stack, leaves the stack pointer in a mailbox, raises a
+// flag there and waits for the host to lower it.  We poll the flag to see
+// when a breakpoint is hit, and find the registers and the address of the
+// BRK from the stack.
+//
+// To continue, the original byte is put back and the return address on
+// the stack moved back onto it.  The CPU is then stopped and stepped out of
+// the handler, which clears a second mailbox byte on its way out so that we
+// know where it is, and over the original instruction.  Then the BRK goes
+// back and the CPU is let go.
+//
+// Bank 0 must be RAM at $FF80-$FFE7 for this, as it is after mapram, and
+// the code being debugged must be running in native mode.
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Where the handler and its mailbox go, and the vector that points to it
+const (
+	breakMailbox = 0x00_FF80 // saved S (2 bytes), hit flag, handler exit flag
+	breakHandler = 0x00_FF90
+	breakVector  = 0x00_FFE6 // native mode BRK
+)
+
+// How often to check for a breakpoint being hit
+const breakPollInterval = 250 * time.Millisecond
+
+// Most steps expected before the handler clears its exit flag, and the steps
+// from there to the end of the original instruction
+const (
+	breakExitSteps  = 16
+	breakAfterSteps = 7
+)
+
+// A breakpoint
+type breakpoint struct {
+	num  int    // number for the user
+	addr uint32 // where
+	orig byte   // the byte the BRK replaced
+}
+
+// Breakpoint state, for the debug goroutine
+var (
+	breakpoints []*breakpoint // armed breakpoints
+	breakNext   = 1           // number of the next breakpoint
+	breakSaved  []byte        // memory the handler and vector replaced
+	breakHit    bool          // the CPU is waiting in the handler
+	breakHitBP  *breakpoint   // the breakpoint it hit, nil if some other BRK
+	breakSP     uint32        // stack pointer in the handler
+)
+
+// Return the breakpoint handler code
+func breakHandlerCode() []byte {
+	long := func(op byte, addr uint32) []byte {
+		return []byte{op, byte(addr), byte(addr >> 8), byte(addr >> 16)}
+	}
+	var code []byte
+	for _, c := range [][]byte{
+		{0x08, 0xC2, 0x30},         // PHP, REP #$30
+		{0x48, 0xDA, 0x5A, 0x3B},   // PHA, PHX, PHY, TSC
+		long(0x8F, breakMailbox),   // STA >mailbox
+		{0xE2, 0x20, 0xA9, 0x01},   // SEP #$20, LDA #1
+		long(0x8F, breakMailbox+2), // STA >mailbox+2
+		long(0xAF, breakMailbox+2), // wait: LDA >mailbox+2
+		{0xD0, 0xFA},               // BNE wait
+		long(0x8F, breakMailbox+3), // STA >mailbox+3
+		{0xC2, 0x30, 0x7A, 0xFA},   // REP #$30, PLY, PLX
+		{0x68, 0x28, 0x40},         // PLA, PLP, RTI
+	} {
+		code = append(code, c...)
+	}
+	return code
+}
+
+// Write data and read it back to make sure it went in
+func breakWrite(t *neonTarget, addr uint32, data []byte) (bool, error) {
+	if err := t.WriteMemory(addr, data); err != nil {
+		return false, err
+	}
+	buf, err := t.ReadMemory(addr, len(data))
+	if err != nil {
+		return false, err
+	}
+	for i := range data {
+		if buf[i] != data[i] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Install the handler and point the BRK vector at it, saving what was there
+func breakInstall(t *neonTarget) bool {
+	saved, err := t.ReadMemory(breakMailbox, breakVector+2-breakMailbox)
+	if !debugReportError(err) {
+		return false
+	}
+	code := append(make([]byte, breakHandler-breakMailbox), breakHandlerCode()...)
+	ok, err := breakWrite(t, breakMailbox, code)
+	if ok {
+		ok, err = breakWrite(t, breakVector, []byte{breakHandler & 0xFF, breakHandler >> 8 & 0xFF})
+	}
+	if !debugReportError(err) {
+		return false
+	}
+	if !ok {
+		t.WriteMemory(breakMailbox, saved)
+		debugOutputChan <- "Could not install BRK handler, bank 0 must be RAM (try mapram)!\n"
+		return false
+	}
+	breakSaved = saved
+	return true
+}
+
+// Set a breakpoint
+func debugBreak(t *neonTarget, args []string) {
+	args = nonEmpty(args)
+	if len(args) == 0 {
+		debugOutputChan <- "No address specified!\n"
+		return
+	}
+	addr, err := parseAddr(args[0])
+	if err != nil {
+		debugOutputChan <- fmt.Sprintf("Bad address: %s\n", args[0])
+		return
+	}
+	for _, bp := range breakpoints {
+		if bp.addr == addr {
+			debugOutputChan <- fmt.Sprintf("Breakpoint %v is already at $%06X!\n", bp.num, addr)
+			return
+		}
+	}
+	if len(breakpoints) == 0 && !breakInstall(t) {
+		return
+	}
+	orig, err := t.ReadMemory(addr, 1)
+	if !debugReportError(err) {
+		return
+	}
+	ok, err := breakWrite(t, addr, []byte{0x00})
+	if !debugReportError(err) {
+		return
+	}
+	if !ok {
+		debugOutputChan <- fmt.Sprintf("Could not write BRK at $%06X, is it RAM?\n", addr)
+		if len(breakpoints) == 0 {
+			breakUninstall(t)
+		}
+		return
+	}
+	bp := &breakpoint{num: breakNext, addr: addr, orig: orig[0]}
+	breakNext++
+	breakpoints = append(breakpoints, bp)
+	sort.Slice(breakpoints, func(i, j int) bool { return breakpoints[i].addr < breakpoints[j].addr })
+	debugOutputChan <- fmt.Sprintf("Breakpoint %v at %s\n", bp.num, describeAddr(addr))
+}
+
+// Put back what the handler replaced
+func breakUninstall(t *neonTarget) {
+	if breakSaved != nil && debugReportError(t.WriteMemory(breakMailbox, breakSaved)) {
+		breakSaved = nil
+	}
+}
+
+// Delete breakpoints by number
+func debugDelete(t *neonTarget, args []string) {
+	args = nonEmpty(args)
+	if len(args) == 0 {
+		debugOutputChan <- "No breakpoint specified!\n"
+		return
+	}
+	for _, a := range args {
+		n, err := evalExpr(a)
+		i := 0
+		for i < len(breakpoints) && int64(breakpoints[i].num) != n {
+			i++
+		}
+		if err != nil || i == len(breakpoints) {
+			debugOutputChan <- fmt.Sprintf("No breakpoint %s!\n", a)
+			return
+		}
+		bp := breakpoints[i]
+		if !debugReportError(t.WriteMemory(bp.addr, []byte{bp.orig})) {
+			return
+		}
+		breakpoints = append(breakpoints[:i], breakpoints[i+1:]...)
+		debugOutputChan <- fmt.Sprintf("Deleted breakpoint %v at $%06X\n", bp.num, bp.addr)
+	}
+	if len(breakpoints) == 0 && !breakHit {
+		breakUninstall(t)
+	}
+}
+
+// List the breakpoints
+func debugBreaks() {
+	if len(breakpoints) == 0 {
+		debugOutputChan <- "No breakpoints\n"
+		return
+	}
+	for _, bp := range breakpoints {
+		hit := ""
+		if breakHit && bp == breakHitBP {
+			hit = " (stopped here)"
+		}
+		debugOutputChan <- fmt.Sprintf("%3v  %s%s\n", bp.num, describeAddr(bp.addr), hit)
+	}
+}
+
+// Check whether the CPU has hit a breakpoint, reporting it if so
+func debugPollBreaks(t *neonTarget) {
+	if breakSaved == nil || breakHit {
+		return
+	}
+	mbox, err := t.ReadMemory(breakMailbox, 3)
+	if err != nil || mbox[2] == 0 {
+		return
+	}
+	breakSP = uint32(mbox[0]) | uint32(mbox[1])<<8
+	// Y, X, A, P from PHP, then P, PC and PB pushed by BRK
+	stack, err := t.ReadMemory(breakSP+1, 11)
+	if !debugReportError(err) {
+		return
+	}
+	breakHit = true
+	breakHitBP = nil
+	pc := uint32(stack[8]) | uint32(stack[9])<<8
+	at := uint32(stack[10])<<16 | (pc-2)&0xFFFF
+	what := "BRK"
+	for _, bp := range breakpoints {
+		if bp.addr == at {
+			breakHitBP = bp
+			what = fmt.Sprintf("Breakpoint %v", bp.num)
+		}
+	}
+	debugOutputChan <- fmt.Sprintf(
+		"%s hit at %s, A=$%02X%02X X=$%02X%02X Y=$%02X%02X P=$%02X S=$%04X\n",
+		what, describeAddr(at), stack[5], stack[4], stack[3], stack[2],
+		stack[1], stack[0], stack[7], breakSP+11)
+}
+
+// Continue from a breakpoint, running the original instruction and putting
+// the BRK back afterwards.  A BRK that isn't one of ours is just returned
+// from, and so is a breakpoint deleted while the CPU was stopped there once
+// it has been moved back onto the original instruction.
+func breakContinue(t *neonTarget) bool {
+	bp := breakHitBP
+	armed := false
+	for _, b := range breakpoints {
+		armed = armed || b == bp
+	}
+	if bp != nil {
+		// return to the breakpoint rather than after the BRK
+		ret := []byte{byte(bp.addr), byte(bp.addr >> 8)}
+		if !debugReportError(t.WriteMemory(breakSP+9, ret)) {
+			return false
+		}
+	}
+	if !armed {
+		breakHit = false
+		if !debugReportError(t.WriteMemory(breakMailbox+2, []byte{0})) {
+			return false
+		}
+		if len(breakpoints) == 0 {
+			breakUninstall(t)
+		}
+		return true
+	}
+	if !debugReportError(t.Stop()) {
+		return false
+	}
+	if !debugReportError(t.WriteMemory(bp.addr, []byte{bp.orig})) {
+		return false
+	}
+	if !debugReportError(t.WriteMemory(breakMailbox+2, []byte{0, 1})) {
+		return false
+	}
+	breakHit = false
+	left := false
+	for i := 0; i < breakExitSteps && !left; i++ {
+		if !debugReportError(t.Step()) {
+			return false
+		}
+		flag, err := t.ReadMemory(breakMailbox+3, 1)
+		if !debugReportError(err) {
+			return false
+		}
+		left = flag[0] == 0
+	}
+	if !left {
+		debugOutputChan <- fmt.Sprintf("CPU did not leave the BRK handler, breakpoint %v not re-armed!\n", bp.num)
+		return debugReportError(t.Go())
+	}
+	for i := 0; i < breakAfterSteps; i++ {
+		if !debugReportError(t.Step()) {
+			return false
+		}
+	}
+	if !debugReportError(t.WriteMemory(bp.addr, []byte{0x00})) {
+		return false
+	}
+	return debugReportError(t.Go())
+}
+
+// Forget that the CPU was in the handler, after a reset
+func breakReset() {
+	breakHit = false
+}
+
+// Describe an address with its symbol, if it has one
+func describeAddr(addr uint32) string {
+	if name := symbols.describe(addr); name != "" {
+		return fmt.Sprintf("$%06X (%s)", addr, name)
+	}
+	return fmt.Sprintf("$%06X", addr)
+}
@@ -0,0 +1,110 @@
+package main
+
+// Connecting devices while running
+
+// Nico can start without a console or debug device, and connect console,
+// connect debug and disconnect swap them in the running servicers, so a
+// board can be plugged in, or an emulator started, after nico is.  Devices
+// are given as URIs, see neon_transport.go.
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Connect the console or debug port to a device
+func debugConnectCommand(t *neonTarget, args []string) {
+	args = nonEmpty(args)
+	usage := "Usage: connect console|debug <device> [<baud>]\n"
+	if len(args) < 2 {
+		debugOutputChan <- usage
+		return
+	}
+	which, device := strings.ToLower(args[0]), args[1]
+	var baud uint
+	switch {
+	case strings.HasPrefix(strings.ToLower(device), "exec:"):
+		// the rest is the command's arguments
+		device = strings.Join(args[1:], " ")
+	case len(args) > 3:
+		debugOutputChan <- usage
+		return
+	case len(args) == 3:
+		v, err := evalExpr(args[2])
+		if err != nil || v < 1 {
+			debugOutputChan <- fmt.Sprintf("Bad baud rate: %s\n", args[2])
+			return
+		}
+		baud = uint(v)
+	}
+	var err error
+	switch which {
+	case "console":
+		if consoleConn == nil {
+			debugOutputChan <- "No console device in test mode!\n"
+			return
+		}
+		err = consoleConnect(device, baud)
+	case "debug":
+		err = debugConnect(t, device, baud)
+	default:
+		debugOutputChan <- usage
+		return
+	}
+	if err != nil {
+		debugOutputChan <- fmt.Sprintf("Failed to connect to %s: %v!\n", device, err)
+		return
+	}
+	r := debugConn
+	if which == "console" {
+		r = consoleConn
+	}
+	debugOutputChan <- fmt.Sprintf("Connected %s to %s\n", which, connectedTo(r, device))
+	if which == "debug" && debugResync(t) {
+		debugOutputChan <- "Debug port in step!\n"
+	}
+}
+
+// Close the console or debug device
+func debugDisconnect(t *neonTarget, args []string) {
+	args = nonEmpty(args)
+	if len(args) != 1 {
+		debugOutputChan <- "Usage: disconnect console|debug\n"
+		return
+	}
+	var r *reconnector
+	switch strings.ToLower(args[0]) {
+	case "console":
+		r = consoleConn
+	case "debug":
+		r = debugConn
+		t.frame = nil
+	default:
+		debugOutputChan <- "Usage: disconnect console|debug\n"
+		return
+	}
+	if r == nil || !r.disconnect() {
+		debugOutputChan <- fmt.Sprintf("No %s device!\n", strings.ToLower(args[0]))
+		return
+	}
+	debugOutputChan <- fmt.Sprintf("Disconnected %s\n", strings.ToLower(args[0]))
+}
+
+// Show what the console and debug port are connected to
+func debugStatus() {
+	console := "test mode"
+	if consoleConn != nil {
+		console = consoleConn.status()
+	}
+	debugOutputChan <- fmt.Sprintf("Console: %s\n", console)
+	debugOutputChan <- fmt.Sprintf("Debug:   %s\n", debugConn.status())
+}
+
+// Name a device just connected, with the path of the other end of a
+// pseudo-terminal
+func connectedTo(r *reconnector, device string) string {
+	if p := r.peer(); p != "" {
+		return fmt.Sprintf("%s (other end %s)", device, p)
+	}
+	return device
+}
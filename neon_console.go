@@ -4,8 +4,6 @@ import (
 	"fmt"
 	"github.com/mgcaret/goncurses"
 	"github.com/jacobsa/go-serial/serial"
-	"net"
-	"os"
 	"time"
 )
 
@@ -29,112 +27,88 @@ func demoConsoleIoServicer() {
 	}
 }
 
-// This returns an appropriate console I/O servicer depending on what device
-// the user has specified.   We support sockets for both testing purposes
-// and connecting to a possible future emulator's serial port.
-func getConsoleIoServicer(device string) consoleIoServicerFunc {
-	fi, err := os.Stat(device)
-	if err != nil {
-		quitChan <- "Error accessing console device"
-		return nil
-	}
-	if (fi.Mode() & os.ModeSocket) != 0 {
-		return getSocketConsoleIoServicer(device)
-	} else if (fi.Mode() & os.ModeDevice) != 0 {
-		return getSerialConsoleIoServicer(device)
-	}
-	quitChan <- "Invalid console device"
-	return nil // n
-}
+// The console device, nil in test mode
+var consoleConn *reconnector
 
-// Return a socket console I/O servicer
-func getSocketConsoleIoServicer(device string) consoleIoServicerFunc {
-	socketReadChan := make(chan string)
-	c, err := net.Dial("unix", device)
-	if err != nil {
-		quitChan <- fmt.Sprintf("Failed to connect to socket %s: %v", device, err)
-		return nil
-	}
-	consoleOutputChan <- fmt.Sprintf("Connected to socket: %s\r\n", device)
-	go func() {
-		ibuf := make([]byte, 1024)
-		for {
-			n, err := c.Read(ibuf)
-			if err != nil {
-				quitChan <- fmt.Sprintf("Error reading from %s: %v", device, err)
-			}
-			socketReadChan <- string(ibuf[0:n])
-		}
-	}()
-	return func() {
-		obuf := make([]byte, 1)
-		for {
-			select {
-			case k := <-consoleInputChan:
-				obuf[0] = byte(k)
-				_, err := c.Write(obuf)
-				if err != nil {
-					quitChan <- fmt.Sprintf("Error writing to %s: %v", device, err)
-				}
-			case s := <-socketReadChan:
-				consoleOutputChan <- s
-			}
+// This returns the console I/O servicer for a device, which may be "" to
+// start with no device and connect one later.  We support sockets for both
+// testing purposes and connecting to a possible future emulator's serial
+// port.
+func getConsoleIoServicer(device string) consoleIoServicerFunc {
+	consoleConn = newReconnector(consoleReport)
+	if device != "" {
+		if err := consoleConnect(device, 0); err != nil {
+			quitChan <- fmt.Sprintf("Failed to connect to %s: %v", device, err)
+			return nil
 		}
+		consoleOutputChan <- fmt.Sprintf("Connected to %s\r\n", connectedTo(consoleConn, device))
 	}
+	return consoleDeviceIoServicer
 }
 
-// Return a serial console I/O servicer
-func getSerialConsoleIoServicer(device string) consoleIoServicerFunc {
-	options := serial.OpenOptions{
-		PortName:        device,
+// Connect the console to a device, in place of any it had, at baud if it
+// isn't 0
+func consoleConnect(device string, baud uint) error {
+	open, speed, err := openTransport(device, baud, serial.OpenOptions{
 		BaudRate:        consoleSpeed,
 		DataBits:        8,
 		StopBits:        1,
 		MinimumReadSize: 1,
-	}
-	serialReadChan := make(chan string)
-	serialWriteChan := make(chan byte, 256)
-	c, err := serial.Open(options)
+	})
 	if err != nil {
-		quitChan <- fmt.Sprintf("Failed to connect to device %s: %v", device, err)
-		return nil
+		return err
 	}
-	consoleOutputChan <- fmt.Sprintf("Connected to device: %s\r\n", device)
-	go func() {
-		ibuf := make([]byte, 1)
-		for {
-			n, err := c.Read(ibuf)
-			if err != nil {
-				quitChan <- fmt.Sprintf("Error reading from %s: %v", device, err)
-				c.Close()
-			}
-			serialReadChan <- string(ibuf[0:n])
+	return consoleConn.connect(device, speed, open)
+}
+
+// Say what's happening with the console device, on the console
+func consoleReport(s string) {
+	consoleOutputChan <- fmt.Sprintf("\r\n*** Console %s ***\r\n", s)
+}
+
+// Read from the console device, sending what is read to readChan.  When it
+// fails or there isn't one, wait for one to be opened and carry on.
+func consoleReader(r *reconnector, readChan chan<- string) {
+	ibuf := make([]byte, 1024)
+	for {
+		n, err := r.Read(ibuf)
+		if n > 0 {
+			readChan <- string(ibuf[0:n])
 		}
-	}()
+		if failed(err) {
+			r.wait()
+		}
+	}
+}
+
+// Console I/O servicer for the console device
+func consoleDeviceIoServicer() {
+	readChan := make(chan string)
+	writeChan := make(chan byte, 256)
+	go consoleReader(consoleConn, readChan)
 	// Separate writer for character pacing
 	go func() {
 		obuf := make([]byte, 1)
 		for {
 			select {
-			case b := <-serialWriteChan:
+			case b := <-writeChan:
+				// keys are dropped while disconnected
 				obuf[0] = b
-				_, err := c.Write(obuf)
-				if err != nil {
-					quitChan <- fmt.Sprintf("Error writing to %s: %v", device, err)
+				consoleConn.Write(obuf)
+				// Pace serial characters so we don't overwhelm the
+				// receive buffer
+				if speed := consoleConn.baud(); speed != 0 {
+					time.Sleep((10000000 / time.Duration(speed)) * time.Microsecond)
 				}
-				// Pace characters so we don't overwhelm the receive buffer
-				time.Sleep((10000000 / time.Duration(consoleSpeed)) * time.Microsecond)
 			}
 		}
 	}()
-	return func() {
-		for {
-			select {
-			case k := <-consoleInputChan:
-				serialWriteChan <- byte(k)
-			case s := <-serialReadChan:
-				consoleOutputChan <- s
-			}
+	for {
+		select {
+		case k := <-consoleInputChan:
+			writeChan <- byte(k)
+		case s := <-readChan:
+			consoleOutputChan <- s
 		}
 	}
 }
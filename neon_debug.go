@@ -1,21 +1,35 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"github.com/jacobsa/go-serial/serial"
-	"github.com/marcinbor85/gohex"
-	"io"
-	"net"
-	"os"
-	"strconv"
+	"sort"
 	"strings"
 	"time"
 )
 
 var (
-	debugSpeed uint = 57600 // console serial speed
+	debugSpeed      uint = 57600            // console serial speed
+	debugChunk           = targetChunkSize  // characters written at once
+	debugReadWindow      = targetReadWindow // reads in flight at once
+	debugRetries         = targetRetries    // times a read is retried
+	debugFrame           = false            // frame reads with reads of the MMU registers
 )
 
+// Line assembler state.  While asmActive, command lines are assembled
+// rather than run.
+var (
+	asmActive bool      // assembling
+	asmAddr   uint32    // where the next line goes
+	asmWidths cpuWidths // register widths for immediate operands
+)
+
+const flashBank = 0x20 // bank where the flash ROM starts
+
+const stepUntilLimit = 1000 // default most steps for step-until
+
 // *** Debug Interfaces ***
 
 // These connect to the debug interface of the target system
@@ -23,18 +37,6 @@ var (
 // They take commands on the debug command channel in the form of
 // words []string and send their results via the debug output channel
 
-// This one does nothing but eat the debug input stream and report
-// an error, in the case where the debug and command inputs are
-// in use, but the debug interface is not connected
-func nullDebugInterface() {
-	for {
-		select {
-		case words := <-debugCommandChan:
-			debugOutputChan <- fmt.Sprintf("Bad command: %s\n", words[0])
-		}
-	}
-}
-
 // To be used when the -no-debug option is specified, just eat any
 // commands that come from the channel
 func noDebugInterface() {
@@ -46,175 +48,205 @@ func noDebugInterface() {
 	}
 }
 
-// Return a debugger interface for the given device.  In this case, we need to
-// abstract the socket or serial device so that we can share the command
-// processing structure, and make sure that the debug interface has access to
-// them.  Note the debug interface is synchronous.
+// The debug device, which the debug goroutine's target talks over
+var debugConn = newReconnector(debugReport)
+
+// Return a debugger interface for the given device, which may be "" to start
+// with no device and connect one later.  In this case, we need to abstract
+// the socket or serial device so that we can share the command processing
+// structure, and make sure that the debug interface has access to them.
+// Note the debug interface is synchronous.
 func getDebugInterface(device string) debugInterfaceFunc {
-	var deviceReadWriter io.ReadWriter
-	fi, err := os.Stat(device)
-	if err != nil {
-		debugOutputChan <- "Error accessing debug interface device\n"
-		return nil
-	}
-	if (fi.Mode() & os.ModeSocket) != 0 {
-		debugSpeed = 0
-		deviceReadWriter, err = net.Dial("unix", device)
-		if err != nil {
-			debugOutputChan <- fmt.Sprintf("Failed to connect to socket %s: %v", device, err)
-			return nil
-		}
-	} else if (fi.Mode() & os.ModeDevice) != 0 {
-		options := serial.OpenOptions{
-			PortName:        device,
-			BaudRate:        debugSpeed,
-			DataBits:        8,
-			StopBits:        1,
-			MinimumReadSize: 0,
-			InterCharacterTimeout: 1000,
-		}
-		deviceReadWriter, err = serial.Open(options)
-		if err != nil {
-			debugOutputChan <- fmt.Sprintf("Failed to connect to device %s: %v", device, err)
-			return nil
+	t := newNeonTarget(debugConn, debugSpeed)
+	t.chunk, t.window, t.retries, t.framed = debugChunk, debugReadWindow, debugRetries, debugFrame
+	if device != "" {
+		if err := debugConnect(t, device, 0); err != nil {
+			debugOutputChan <- fmt.Sprintf("Failed to connect to %s: %v!\n", device, err)
+		} else {
+			debugOutputChan <- fmt.Sprintf("Connected to debugger at %s\n", connectedTo(debugConn, device))
 		}
 	}
-	if deviceReadWriter == nil {
-		debugOutputChan <- "Invalid debug interface device"
-		return nil
-	}
-	debugOutputChan <- fmt.Sprintf("Connected to debugger at %s\n", device)
 	return func() {
-		debugResync(deviceReadWriter)
+		if debugConn.connected() {
+			debugResync(t)
+		}
+		poll := time.NewTicker(breakPollInterval)
+		watchPoll := time.NewTicker(watchInterval)
 		for {
 			select {
 			case words := <-debugCommandChan:
-				doDebugCommand(deviceReadWriter, words)
+				debugCommand(t, words)
+			case <-debugAbortChan:
+				jobAbort(true)
+			case j := <-jobDone:
+				jobFinish(t, j)
+			case <-poll.C:
+				if job == nil {
+					debugPollBreaks(t)
+				}
+			case <-watchPoll.C:
+				if job == nil {
+					debugPollWatches(t)
+				}
+			case in := <-memeditInputChan:
+				memeditKey(t, in)
 			}
 		}
 	}
 }
-func doDebugCommand(rw io.ReadWriter, words []string) {
-CmdSwitch:
+
+// Connect the debug port to a device, in place of any it had, at baud if
+// it isn't 0
+func debugConnect(t *neonTarget, device string, baud uint) error {
+	open, speed, err := openTransport(device, baud, serial.OpenOptions{
+		BaudRate:              debugSpeed,
+		DataBits:              8,
+		StopBits:              1,
+		MinimumReadSize:       0,
+		InterCharacterTimeout: 1000,
+	})
+	if err != nil {
+		return err
+	}
+	if err := debugConn.connect(device, speed, open); err != nil {
+		return err
+	}
+	// a different Neon, or the same one in an unknown state
+	t.speed, t.frame, t.idle = speed, nil, time.Time{}
+	return nil
+}
+
+// Say what's happening with the debug device
+func debugReport(s string) {
+	debugOutputChan <- fmt.Sprintf("Debug device %s!\n", s)
+}
+
+// Perform a debug command against the target, reporting results to the
+// debug output channel
+func doDebugCommand(t *neonTarget, words []string) {
+	if asmActive {
+		debugAsmLine(t, words)
+		return
+	}
 	switch strings.ToLower(words[0]) {
 	case "stop":
-		rw.Write([]byte("]"))
-		debugOutputChan <- "Stop sent!\n"
+		if debugReportError(t.Stop()) {
+			debugOutputChan <- "Stop sent!\n"
+		}
 	case "cont", "go":
-		rw.Write([]byte("["))
-		debugOutputChan <- "Go sent!\n"
+		if breakHit {
+			if breakContinue(t) {
+				debugOutputChan <- "Continuing from breakpoint!\n"
+			}
+		} else if debugReportError(t.Go()) {
+			debugOutputChan <- "Go sent!\n"
+		}
 	case "reset":
-		rw.Write([]byte("R"))
-		debugOutputChan <- "Reset sent!\n"
+		breakReset()
+		if debugReportError(t.Reset()) {
+			debugOutputChan <- "Reset sent!\n"
+		}
 	case "step":
-		rw.Write([]byte("X"))
-		debugOutputChan <- "Step sent!\n"
+		debugStep(t, words[1:])
+	case "step-until":
+		debugStepUntil(t, words[1:])
 	case "run":
-		rw.Write([]byte("]R["))
-		debugOutputChan <- "Run sent!\n"
+		breakReset()
+		if debugReportError(t.Run()) {
+			debugOutputChan <- "Run sent!\n"
+		}
 	case "read":
 		args := words[1:]
 		for _, a := range args {
 			if a == "" {
 				continue // ignore empty strings
 			}
-			addr, err := strconv.ParseUint(a, 0, 24)
+			addr, err := parseAddr(a)
 			if err != nil {
 				debugOutputChan <- fmt.Sprintf("Bad address: %s\n", a)
 				continue
 			}
-			debugWriteHex(rw, uint(addr>>16), 2)
-			debugWriteChars(rw, ":")
-			debugWriteHex(rw, uint(addr), 4)
-			debugWriteChars(rw, "#")
-			for j := 0; j < 4; j++ {
-				buf := make([]uint, 16)
-				for i := 0; i < 16; i++ {
-					debugWriteChars(rw, "@")
-					buf[i] = debugReadByte(rw)
-				}
-				debugOutputChan <- fmt.Sprintf("%08X  ", addr)
-				for i, v := range buf {
-					if i == 8 {
-						debugOutputChan <- " "
-					}
-					debugOutputChan <- fmt.Sprintf("%02X ", v)
-				}
-				debugOutputChan <- "["
-				for _, v := range buf {
-					if v >= 32 && v < 127 {
-						debugOutputChan <- string(v)
-					} else {
-						debugOutputChan <- " "
-					}
-				}
-				debugOutputChan <- "]\n"
-				addr += 16
-			}
+			buf, err := t.ReadMemory(addr, 0x40)
+			debugOutputChan <- formatHexDump(addr, buf)
+			debugReportError(err)
 		}
+	case "dump":
+		debugDump(t, words[1:])
+	case "disasm":
+		debugDisasm(t, words[1:])
+	case "asm":
+		debugAsm(words[1:])
+	case "symbols":
+		debugSymbols(words[1:])
+	case "calc":
+		debugCalc(words[1:])
+	case "break":
+		debugBreak(t, words[1:])
+	case "delete":
+		debugDelete(t, words[1:])
+	case "breaks":
+		debugBreaks()
+	case "watch":
+		debugWatch(words[1:])
+	case "unwatch":
+		debugUnwatch(words[1:])
+	case "memedit":
+		debugMemedit(words[1:])
 	case "write":
 		args := words[1:]
 		haveAddr := false
-		byteCount := 0
+		var addr uint32
+		var data []byte
+	WriteArgs:
 		for _, a := range args {
 			if a == "" {
 				continue // ignore empty strings
 			}
 			if haveAddr {
-				dat, err := strconv.ParseUint(a, 0, 8)
+				dat, err := parseByte(a)
 				if err != nil {
 					debugOutputChan <- fmt.Sprintf("Bad data: %s\n", a)
-					break
+					break WriteArgs
 				}
-				debugWriteHex(rw, uint(dat), 2)
-				debugWriteChars(rw, "!")
-				byteCount++
+				data = append(data, dat)
 			} else {
-				addr, err := strconv.ParseUint(a, 0, 24)
+				var err error
+				addr, err = parseAddr(a)
 				if err != nil {
 					debugOutputChan <- fmt.Sprintf("Bad address: %s\n", a)
-					break
+					break WriteArgs
 				}
-				debugWriteHex(rw, uint(addr>>16), 2)
-				debugWriteChars(rw, ":")
-				debugWriteHex(rw, uint(addr), 4)
-				debugWriteChars(rw, "#")
 				haveAddr = true
 			}
 		}
-		plural := "s"
-		if byteCount == 1 {
-			plural = ""
+		if !haveAddr || !debugReportError(t.WriteMemory(addr, data)) {
+			data = nil
 		}
-		debugOutputChan <- fmt.Sprintf("Wrote %v byte%s!\n", byteCount, plural)
+		debugOutputChan <- fmt.Sprintf("Wrote %v byte%s!\n", len(data), plural(len(data)))
 	case "program", "verify":
 		program := strings.ToLower(words[0]) == "program"
-		args := words[1:]
-		if len(args) > 0 && args[0] == "" {
-			args = args[1:]
+		allowed := []string{}
+		if !program {
+			allowed = append(allowed, "diff")
+		}
+		opts, args, ok := splitOptions(words[1:], allowed...)
+		if !ok {
+			break
 		}
 		if len(args) == 0 {
 			debugOutputChan <- "No file specified!\n"
 			break // out of switch
 		}
-		file, err := os.Open(args[0])
-		if err != nil {
-			debugOutputChan <- fmt.Sprintf("Could not open %s: %v\n", args[0], err)
+		segments, ok := debugLoadImage(args, false)
+		if !ok {
 			break
 		}
-		defer file.Close()
-		mem := gohex.NewMemory()
-		err = mem.ParseIntelHex(file)
-		if err != nil {
-			debugOutputChan <- fmt.Sprintf("Could not parse %s: %v\n", args[0], err)
+		t.send("]R")
+		if !debugReportError(t.flush()) {
 			break
 		}
-		debugWriteChars(rw, "]R")
-		for segNum, segment := range mem.GetDataSegments() {
-			plural := "s"
-			if len(segment.Data) == 1 {
-				plural = ""
-			}
+		report := &verifyReport{}
+		for segNum, segment := range segments {
 			if program {
 				debugOutputChan <- "Programming"
 			} else {
@@ -223,76 +255,66 @@ CmdSwitch:
 			debugOutputChan <- fmt.Sprintf(
 				" segment %v at 0x%08x, %v byte%s\n",
 				segNum, segment.Address, len(segment.Data),
-				plural)
-			debugWriteHex(rw, uint(segment.Address>>16), 2)
-			debugWriteChars(rw, ":")
-			debugWriteHex(rw, uint(segment.Address), 4)
-			debugWriteChars(rw, "#")
-			for idx, dat := range segment.Data {
-				if idx != 0 && ((segment.Address+uint32(idx))&0xFFFF == 0) {
-					// roll over to next bank
-					debugWriteHex(rw, uint(segment.Address+uint32(idx))>>16, 2)
-					debugWriteChars(rw, ":")
-					debugWriteHex(rw, 0, 4)
-					debugWriteChars(rw, "#")
-				}
-				if program {
-					debugWriteHex(rw, uint(dat), 2)
-					debugWriteChars(rw, "!")
-				} else {
-					debugWriteChars(rw, "@")
-					b := debugReadByte(rw)
-					if b != uint(dat) {
-						debugOutputChan <- fmt.Sprintf("Validation failed at %08x!\n", segment.Address+uint32(idx))
-						break CmdSwitch
-					}
+				plural(len(segment.Data)))
+			if program {
+				if !debugReportError(t.WriteMemory(segment.Address, segment.Data)) {
+					return
 				}
+			} else if !debugVerify(t, report, segment.Address, segment.Data, false) {
+				return
 			}
 			debugOutputChan <- "Segment complete!\n"
 		}
 		if program {
 			debugOutputChan <- "Program complete!\n"
 		} else {
-			debugOutputChan <- "Verify complete!\n"
+			debugVerifyDone(report, opts["diff"])
 		}
 	case "flash", "verify-rom":
 		program := strings.ToLower(words[0]) == "flash"
-		args := words[1:]
-		if len(args) > 0 && args[0] == "" {
-			args = args[1:]
+		allowed := []string{"diff"}
+		if program {
+			allowed = []string{"sectors"}
+		}
+		opts, args, ok := splitOptions(words[1:], allowed...)
+		if !ok {
+			break
 		}
 		if len(args) == 0 {
 			debugOutputChan <- "No file specified!\n"
 			break // out of switch
 		}
-		file, err := os.Open(args[0])
-		if err != nil {
-			debugOutputChan <- fmt.Sprintf("Could not open %s: %v\n", args[0], err)
+		segments, ok := debugLoadImage(args, true)
+		if !ok {
 			break
 		}
-		defer file.Close()
-		mem := gohex.NewMemory()
-		err = mem.ParseIntelHex(file)
-		if err != nil {
-			debugOutputChan <- fmt.Sprintf("Could not parse %s: %v\n", args[0], err)
+		chip, ok := debugFlashChip(t)
+		if !ok || !debugCheckFit(chip, segments) {
+			break
+		}
+		if _, sectors := opts["sectors"]; sectors {
+			if debugFlashSectors(t, chip, segments) {
+				debugOutputChan <- "Flash complete!\n"
+			}
 			break
 		}
 		if program {
-			debugWriteChars(rw, "]R")
 			debugOutputChan <- "Erasing chip...\n"
-			debugEraseChip(rw, 0x20)
+			jobStatus("erasing chip")
+			if !debugReportError(t.EraseChip(chip, flashBank)) {
+				break
+			}
 			debugOutputChan <- "Flashing...\n"
 		} else {
-			debugWriteChars(rw, "]")
+			t.send("]")
+			if !debugReportError(t.flush()) {
+				break
+			}
 			debugOutputChan <- "Verifying...\n"
 		}
-		for segNum, segment := range mem.GetDataSegments() {
-			plural := "s"
-			if len(segment.Data) == 1 {
-				plural = ""
-			}
-			// Force segments into flash address space
-			segAddr := 0x20_0000 | (segment.Address & 0x0F_FFFF)
+		report := &verifyReport{}
+		for segNum, segment := range segments {
+			segAddr := flashAddr(segment.Address)
 			if program {
 				debugOutputChan <- "Programming"
 			} else {
@@ -301,212 +323,715 @@ CmdSwitch:
 			debugOutputChan <- fmt.Sprintf(
 				" segment %v at 0x%08x, %v byte%s\n",
 				segNum, segAddr, len(segment.Data),
-				plural)
-			debugWriteHex(rw, uint(segAddr>>16), 2)
-			debugWriteChars(rw, ":")
-			if !program {
-				debugWriteHex(rw, 0, 4)
-				debugWriteChars(rw, "#")
-			}
-			for idx, dat := range segment.Data {
-				if idx&0x7FF == 0 {
-					debugOutputChan <- fmt.Sprintf("%v%%\r", idx*100/len(segment.Data))
-				}
-				if idx != 0 && ((segAddr+uint32(idx))&0xFFFF == 0) {
-					// roll over to next bank
-					debugWriteHex(rw, uint(segAddr+uint32(idx))>>16, 2)
-					debugWriteChars(rw, ":")
-					if !program {
-						debugWriteHex(rw, 0, 4)
-						debugWriteChars(rw, "#")
-					}
-				}
-				if program {
-					// Since the erased chip is all 0xFF, we won't write those.
-					// This will speed up flashing.
-					if dat != 0xFF {
-						debugWriteCmd(rw, 0x5555, 0xAA)
-						debugWriteCmd(rw, 0x2AAA, 0x55)
-						debugWriteCmd(rw, 0x5555, 0xA0)
-						debugWriteCmd(rw, uint(segAddr+uint32(idx))&0xFFFF, uint(dat))
-						//debugCmdWait(20) // probably not needed
-					}
-				} else {
-					debugWriteChars(rw, "@")
-					b := debugReadByte(rw)
-					if b != uint(dat) {
-						debugOutputChan <- fmt.Sprintf("Validation failed at %08x!\n", segAddr+uint32(idx))
-						break CmdSwitch
-					}
+				plural(len(segment.Data)))
+			if program {
+				if !debugFlash(t, chip, segAddr, segment.Data) {
+					return
 				}
+			} else if !debugVerify(t, report, segAddr, segment.Data, true) {
+				return
 			}
 			debugOutputChan <- "Segment complete!\n"
 		}
 		if program {
-			debugOutputChan <- "Flash"
+			debugOutputChan <- "Flash complete!\n"
 		} else {
-			debugOutputChan <- "Verify"
+			debugVerifyDone(report, opts["diff"])
 		}
-		debugOutputChan <- " complete!\n"
+	case "backup-rom":
+		args := nonEmpty(words[1:])
+		if len(args) == 0 {
+			debugOutputChan <- "No file specified!\n"
+			break
+		}
+		chip, ok := debugFlashChip(t)
+		if !ok {
+			break
+		}
+		debugOutputChan <- "Reading...\n"
+		data, ok := debugReadMemory(t, flashBank<<16, int(chip.size), true)
+		if !ok {
+			break
+		}
+		if err := saveMemoryFile(args[0], flashBank<<16, data); err != nil {
+			debugOutputChan <- fmt.Sprintf("Could not save %s: %v\n", args[0], err)
+			break
+		}
+		debugOutputChan <- fmt.Sprintf("Saved %vK flash ROM to %s!\n", chip.size/1024, args[0])
 	case "mapram":
-		debugWriteChars(rw, "]R")
-		debugWriteHex(rw, 0x08, 2)
-		debugWriteChars(rw, ":")
-		for i := uint(0); i < 16; i++ {
-			debugWriteCmd(rw, 2*i, i*16)
-			debugWriteCmd(rw, 2*i+1, 0x80)
-		}
-		debugOutputChan <- "RAM mapped to bank 0!\n"
+		t.send("]R")
+		if mmuWrite(t, mmuBankLayout(0x80)) {
+			debugOutputChan <- "RAM mapped to bank 0!\n"
+		}
+	case "map":
+		debugMap(t, words[1:])
+	case "map-preset":
+		debugMapPreset(t, words[1:])
+	case "mapping":
+		debugMapping()
 	case "erase":
-		debugEraseChip(rw, 0x20)
-		debugOutputChan <- "Flash ROM erased!\n"
+		chip, ok := debugFlashChip(t)
+		if ok && debugReportError(t.EraseChip(chip, flashBank)) {
+			debugOutputChan <- "Flash ROM erased!\n"
+		}
+	case "erase-sector":
+		args := nonEmpty(words[1:])
+		if len(args) == 0 {
+			debugOutputChan <- "No address specified!\n"
+			break
+		}
+		addr, err := parseAddr(args[0])
+		if err != nil {
+			debugOutputChan <- fmt.Sprintf("Bad address: %s\n", args[0])
+			break
+		}
+		chip, ok := debugFlashChip(t)
+		if !ok {
+			break
+		}
+		if chip.sectorSize == 0 {
+			debugOutputChan <- fmt.Sprintf("%s has no sector erase!\n", chip.name)
+			break
+		}
+		sa := flashAddr(addr) &^ (chip.sectorSize - 1)
+		if debugReportError(t.EraseSector(chip, sa)) {
+			debugOutputChan <- fmt.Sprintf("Flash sector at $%06X erased!\n", sa)
+		}
 	case "chipid":
-		id0, id1 := debugChipID(rw, 0x20)
-		debugOutputChan <- "Manufacturer: "
-		switch id0 {
-		case 0xBF:
-			debugOutputChan <- "SST, device: "
-			switch id1 {
-			case 0xD5:
-				debugOutputChan <- "39xF010 (128K)\n"
-			case 0xD6:
-				debugOutputChan <- "39xF020 (256K)\n"
-			case 0xD7:
-				debugOutputChan <- "39xF040 (512K)\n"
-			default:
-				debugOutputChan <- fmt.Sprintf("0x%02X\n", id1)
-			}
-		default:
-			debugOutputChan <- fmt.Sprintf("0x%02X, device: 0x%02X\n", id0, id1)
+		id0, id1, err := t.ChipID(flashBank)
+		if !debugReportError(err) {
+			break
+		}
+		debugOutputChan <- fmt.Sprintf("Manufacturer: %s, device: ", flashMfrName(id0))
+		if chip := findFlashChip(id0, id1); chip != nil {
+			debugOutputChan <- fmt.Sprintf("%v\n", chip)
+		} else {
+			debugOutputChan <- fmt.Sprintf("0x%02X (unknown)\n", id1)
 		}
 	case "resync":
-		debugResync(rw)
+		if debugResync(t) {
+			debugOutputChan <- "Debug port in step!\n"
+		}
+	case "connect":
+		debugConnectCommand(t, words[1:])
+	case "disconnect":
+		debugDisconnect(t, words[1:])
+	case "status":
+		debugStatus()
 	default:
 		debugOutputChan <- fmt.Sprintf("Unknown command: '%s'\n", words[0])
 	}
 }
 
-func debugWriteChars(rw io.ReadWriter, s string) {
-	var err error
-	obuf := make([]byte, 1)
-	for _, b := range []byte(s) {
-		obuf[0] = b
-		_, err = rw.Write(obuf)
-		if err != nil {
-			break
+// Report an error from the target, if any.  Returns true if there was no
+// error so that callers can carry on.
+func debugReportError(err error) bool {
+	if errors.Is(err, errTargetAborted) {
+		jobStopped()
+		debugOutputChan <- "Aborted!\n"
+		return false
+	}
+	if err != nil {
+		jobFailed()
+		debugOutputChan <- fmt.Sprintf("Debug error: %v!\n", err)
+		return false
+	}
+	return true
+}
+
+// Parse a 24-bit address expression
+func parseAddr(s string) (uint32, error) {
+	v, err := evalExpr(s)
+	if err == nil && (v < 0 || v > 0xFF_FFFF) {
+		err = fmt.Errorf("address out of range")
+	}
+	return uint32(v), err
+}
+
+// Parse a byte value expression
+func parseByte(s string) (byte, error) {
+	v, err := evalExpr(s)
+	if err == nil && (v < 0 || v > 0xFF) {
+		err = fmt.Errorf("value out of range")
+	}
+	return byte(v), err
+}
+
+// Format memory as a hex dump, 16 bytes per line
+func formatHexDump(addr uint32, buf []byte) string {
+	var sb strings.Builder
+	for len(buf) > 0 {
+		line := buf
+		if len(line) > 16 {
+			line = line[:16]
+		}
+		sb.WriteString(fmt.Sprintf("%08X  ", addr))
+		for i, v := range line {
+			if i == 8 {
+				sb.WriteString(" ")
+			}
+			sb.WriteString(fmt.Sprintf("%02X ", v))
 		}
-		if debugSpeed > 0 {
-			// Pace characters so we don't overwhelm the receive buffer
-			time.Sleep((10000000 / time.Duration(debugSpeed)) * time.Microsecond)
+		for i := len(line); i < 16; i++ {
+			// pad out a short last line
+			if i == 8 {
+				sb.WriteString(" ")
+			}
+			sb.WriteString("   ")
+		}
+		sb.WriteString("[")
+		for _, v := range line {
+			if v >= 32 && v < 127 {
+				sb.WriteByte(v)
+			} else {
+				sb.WriteString(" ")
+			}
 		}
+		sb.WriteString("]")
+		if name := symbols.describe(addr); name != "" {
+			sb.WriteString("  " + name)
+		}
+		sb.WriteString("\n")
+		addr += uint32(len(line))
+		buf = buf[len(line):]
+	}
+	return sb.String()
+}
+
+// Read an arbitrary amount of memory, showing it or saving it to a file
+func debugDump(t *neonTarget, args []string) {
+	args = nonEmpty(args)
+	if len(args) < 2 {
+		debugOutputChan <- "Usage: dump <addr> <length> [file]\n"
+		return
 	}
+	addr, err := parseAddr(args[0])
 	if err != nil {
-		debugOutputChan <- fmt.Sprintf("Error writing to debug device: %v\n", err)
+		debugOutputChan <- fmt.Sprintf("Bad address: %s\n", args[0])
+		return
+	}
+	length, err := evalExpr(args[1])
+	if err != nil || length <= 0 || length > 0x100_0000 {
+		debugOutputChan <- fmt.Sprintf("Bad length: %s\n", args[1])
+		return
+	}
+	data, ok := debugReadMemory(t, addr, int(length), len(args) > 2)
+	if len(args) < 3 {
+		debugOutputChan <- formatHexDump(addr, data)
+		return
+	}
+	if !ok {
+		return
+	}
+	if err := saveMemoryFile(args[2], addr, data); err != nil {
+		debugOutputChan <- fmt.Sprintf("Could not save %s: %v\n", args[2], err)
+		return
 	}
+	debugOutputChan <- fmt.Sprintf("Saved $%X bytes from $%06X to %s!\n", len(data), addr, args[2])
 }
 
-func debugWriteHex(rw io.ReadWriter, v uint, l uint) {
-	for i := uint(0); i < l; i++ {
-		n := (v >> (4 * (l - i - 1))) & 0xF
-		debugWriteChars(rw, fmt.Sprintf("%X", n))
+// Disassemble memory, starting with the register widths given by the
+// options or the defaults
+func debugDisasm(t *neonTarget, args []string) {
+	opts, args, ok := splitOptions(args, "m", "x", "e")
+	if !ok {
+		return
+	}
+	if len(args) < 1 {
+		debugOutputChan <- "Usage: disasm [--m=8|16] [--x=8|16] [--e] <addr> [count]\n"
+		return
+	}
+	addr, err := parseAddr(args[0])
+	if err != nil {
+		debugOutputChan <- fmt.Sprintf("Bad address: %s\n", args[0])
+		return
+	}
+	count := int64(16)
+	if len(args) > 1 {
+		count, err = evalExpr(args[1])
+		if err != nil || count <= 0 || count > 0xFFFF {
+			debugOutputChan <- fmt.Sprintf("Bad count: %s\n", args[1])
+			return
+		}
+	}
+	w, ok := debugWidths(opts)
+	if !ok {
+		return
+	}
+	// instructions are at most 4 bytes
+	code, ok := debugReadMemory(t, addr, int(count)*4, false)
+	if !ok {
+		return
 	}
+	debugOutputChan <- fmt.Sprintf("Disassembling with %v\n", w)
+	listing, _ := formatDisassembly(addr, code, int(count), &w)
+	debugOutputChan <- listing
 }
 
-func debugWriteCmd(rw io.ReadWriter, addr uint, dat uint) {
-	debugWriteHex(rw, addr, 4)
-	debugWriteChars(rw, "#")
-	debugWriteHex(rw, dat, 2)
-	debugWriteChars(rw, "!")
+// Return the register widths given by --m, --x and --e options, or the
+// defaults
+func debugWidths(opts map[string]string) (cpuWidths, bool) {
+	w := defaultWidths()
+	for _, reg := range []struct {
+		name string
+		is8  *bool
+	}{{"m", &w.m8}, {"x", &w.x8}} {
+		v, ok := opts[reg.name]
+		if !ok {
+			continue
+		}
+		switch v {
+		case "8":
+			*reg.is8 = true
+		case "16":
+			*reg.is8 = false
+		default:
+			debugOutputChan <- fmt.Sprintf("Bad width: --%s=%s\n", reg.name, v)
+			return w, false
+		}
+	}
+	if _, ok := opts["e"]; ok {
+		w.e, w.m8, w.x8 = true, true, true
+	}
+	return w, true
+}
+
+// Step the CPU once, or as many times as asked
+func debugStep(t *neonTarget, args []string) {
+	args = nonEmpty(args)
+	if len(args) == 0 {
+		if debugReportError(t.Step()) {
+			debugOutputChan <- "Step sent!\n"
+		}
+		return
+	}
+	n, err := evalExpr(args[0])
+	if err != nil || n <= 0 {
+		debugOutputChan <- fmt.Sprintf("Bad count: %s\n", args[0])
+		return
+	}
+	for i := int64(0); i < n; i++ {
+		jobStatus("step %v of %v", i+1, n)
+		if !debugReportError(t.aborted()) || !debugReportError(t.Step()) {
+			debugOutputChan <- fmt.Sprintf("Stopped after %v step%s!\n", i, plural(int(i)))
+			return
+		}
+	}
+	debugOutputChan <- fmt.Sprintf("Stepped %v time%s!\n", n, plural(int(n)))
 }
 
-func debugCmdWait(t int) {
-	// Can't sync with go-serial, unfortunately
-	// just have to hope this works
-	time.Sleep(time.Duration(t) * time.Microsecond)
+// Comparisons for step-until
+var stepConditions = map[string]func(v, want int64) bool{
+	"==": func(v, want int64) bool { return v == want },
+	"!=": func(v, want int64) bool { return v != want },
+	"<":  func(v, want int64) bool { return v < want },
+	"<=": func(v, want int64) bool { return v <= want },
+	">":  func(v, want int64) bool { return v > want },
+	">=": func(v, want int64) bool { return v >= want },
+	"&":  func(v, want int64) bool { return v&want != 0 },
 }
 
-func debugReadByte(rw io.ReadWriter) uint {
-	buf := make([]byte, 2)
-	_, err := rw.Read(buf)
+// Step until the byte or word at an address meets a condition or changes,
+// or the step limit is reached
+func debugStepUntil(t *neonTarget, args []string) {
+	opts, args, ok := splitOptions(args, "word", "limit")
+	if !ok {
+		return
+	}
+	usage := "Usage: step-until [--word] [--limit=<n>] <addr> <op> <value> | <addr> changes\n"
+	if len(args) < 2 {
+		debugOutputChan <- usage
+		return
+	}
+	addr, err := parseAddr(args[0])
 	if err != nil {
-		debugOutputChan <- fmt.Sprintf("Error reading from debug device: %v\n", err)
-	} else {
-		i, err := strconv.ParseUint(string(buf), 16, 8)
+		debugOutputChan <- fmt.Sprintf("Bad address: %s\n", args[0])
+		return
+	}
+	op := args[1]
+	cond, known := stepConditions[op]
+	var want int64
+	switch {
+	case op == "changes" && len(args) == 2:
+	case known && len(args) == 3:
+		want, err = evalExpr(args[2])
 		if err != nil {
-			debugOutputChan <- fmt.Sprintf("Error parsing data from debug device: %v\n", err)
-		}
-		return uint(i)
-	}
-	return 0
-}
-
-func debugEraseChip(rw io.ReadWriter, bank uint) {
-	// Stop & reset
-	debugWriteChars(rw, "]R")
-	// Send bank of flash chip
-	debugWriteHex(rw, bank, 2)
-	debugWriteChars(rw, ":")
-	// Erase chip
-	debugWriteCmd(rw, 0x5555, 0xAA)
-	debugWriteCmd(rw, 0x2AAA, 0x55)
-	debugWriteCmd(rw, 0x5555, 0x80)
-	debugWriteCmd(rw, 0x5555, 0xAA)
-	debugWriteCmd(rw, 0x2AAA, 0x55)
-	debugWriteCmd(rw, 0x5555, 0x10)
-	debugCmdWait(100000)
-}
-
-func debugEraseSector(rw io.ReadWriter, sa uint) {
-	// Stop
-	debugWriteChars(rw, "]")
-	// Send bank of flash chip
-	debugWriteHex(rw, (sa >> 16) & 0xF0, 2)
-	debugWriteChars(rw, ":")
-	// Erase sector
-	debugWriteCmd(rw, 0x5555, 0xAA)
-	debugWriteCmd(rw, 0x2AAA, 0x55)
-	debugWriteCmd(rw, 0x5555, 0x80)
-	debugWriteCmd(rw, 0x5555, 0xAA)
-	debugWriteCmd(rw, 0x2AAA, 0x55)
-	debugWriteHex(rw, sa >> 16, 2)
-	debugWriteChars(rw, ":")
-	debugWriteCmd(rw, sa & 0xFFFF, 0x30)
-	debugCmdWait(50000)
-}
-
-func debugChipID(rw io.ReadWriter, bank uint) (uint, uint) {
-	// Stop
-	debugWriteChars(rw, "]")
-	// Send bank of flash chip
-	debugWriteHex(rw, bank, 2)
-	debugWriteChars(rw, ":")
-	// Software ID mode enter
-	debugWriteCmd(rw, 0x5555, 0xAA)
-	debugWriteCmd(rw, 0x2AAA, 0x55)
-	debugWriteCmd(rw, 0x5555, 0x90)
-	// Now read the ID bytes
-	debugWriteHex(rw, 0, 4)
-	debugWriteChars(rw, "#")
-	debugWriteChars(rw, "@")
-	id0 := debugReadByte(rw)
-	debugWriteChars(rw, "@")
-	id1 := debugReadByte(rw)
-	// Software ID mode exit
-	debugWriteCmd(rw, 0x5555, 0xAA)
-	debugWriteCmd(rw, 0x2AAA, 0x55)
-	debugWriteCmd(rw, 0x5555, 0xF0)
-	return id0, id1
-}
-
-func debugResync(rw io.ReadWriter) int {
-	buf := make([]byte, 16)
-	n, _ := rw.Read(buf)
-	if n > 0 {
-		plural := "s"
-		if n == 1 {
-			plural = ""
+			debugOutputChan <- fmt.Sprintf("Bad value: %s\n", args[2])
+			return
 		}
-		debugOutputChan <- fmt.Sprintf("Discarded %v byte%s from debug device.\n", n, plural)
+	default:
+		debugOutputChan <- usage
+		return
+	}
+	limit := int64(stepUntilLimit)
+	if l, ok := opts["limit"]; ok {
+		limit, err = evalExpr(l)
+		if err != nil || limit <= 0 {
+			debugOutputChan <- fmt.Sprintf("Bad limit: %s\n", l)
+			return
+		}
+	}
+	size, format := 1, "$%06X = $%02X"
+	if _, word := opts["word"]; word {
+		size, format = 2, "$%06X = $%04X"
+	}
+	read := func() (int64, bool) {
+		buf, err := t.ReadMemory(addr, size)
+		if !debugReportError(err) {
+			return 0, false
+		}
+		v := int64(buf[0])
+		if size == 2 {
+			v |= int64(buf[1]) << 8
+		}
+		return v, true
+	}
+	if op == "changes" {
+		if want, ok = read(); !ok {
+			return
+		}
+		cond = func(v, want int64) bool { return v != want }
+	}
+	for i := int64(1); i <= limit; i++ {
+		jobStatus("step %v of %v", i, limit)
+		if !debugReportError(t.aborted()) || !debugReportError(t.Step()) {
+			return
+		}
+		v, ok := read()
+		if !ok {
+			return
+		}
+		if cond(v, want) {
+			debugOutputChan <- fmt.Sprintf("Condition met after %v step%s, "+format+"\n",
+				i, plural(int(i)), addr, v)
+			return
+		}
+		if i == limit {
+			debugOutputChan <- fmt.Sprintf("Condition not met after %v step%s, "+format+"\n",
+				i, plural(int(i)), addr, v)
+		}
+	}
+}
+
+// Evaluate an expression, showing the result in hex, decimal and binary
+func debugCalc(args []string) {
+	expr := strings.Join(args, "")
+	if expr == "" {
+		debugOutputChan <- "Usage: calc <expr>\n"
+		return
+	}
+	v, err := evalExpr(expr)
+	if err != nil {
+		debugOutputChan <- fmt.Sprintf("Bad expression: %v\n", err)
+		return
+	}
+	// negative values are shown as 32-bit two's complement
+	u := uint32(v)
+	bits := 8
+	for bits < 32 && u>>uint(bits) != 0 {
+		bits += 8
+	}
+	debugOutputChan <- fmt.Sprintf("$%X  %d  %%%0*b\n", u, v, bits, u)
+}
+
+// Load symbol files, or forget the symbols with --clear
+func debugSymbols(args []string) {
+	opts, args, ok := splitOptions(args, "clear")
+	if !ok {
+		return
+	}
+	if _, clear := opts["clear"]; clear {
+		symbols = newSymbolTable()
+		debugOutputChan <- "Symbols cleared!\n"
+	}
+	for _, name := range args {
+		n, err := symbols.load(name)
+		if err != nil {
+			debugOutputChan <- fmt.Sprintf("Could not load %s: %v\n", name, err)
+			return
+		}
+		debugOutputChan <- fmt.Sprintf("Loaded %v symbol%s from %s\n", n, plural(n), name)
+	}
+	if len(args) == 0 && len(opts) == 0 {
+		n := len(symbols.byAddr)
+		debugOutputChan <- fmt.Sprintf("%v symbol%s loaded\n", n, plural(n))
+	}
+}
+
+// Start the line assembler
+func debugAsm(args []string) {
+	opts, args, ok := splitOptions(args, "m", "x", "e")
+	if !ok {
+		return
+	}
+	if len(args) < 1 {
+		debugOutputChan <- "Usage: asm [--m=8|16] [--x=8|16] [--e] <addr>\n"
+		return
+	}
+	addr, err := parseAddr(args[0])
+	if err != nil {
+		debugOutputChan <- fmt.Sprintf("Bad address: %s\n", args[0])
+		return
+	}
+	w, ok := debugWidths(opts)
+	if !ok {
+		return
+	}
+	asmActive, asmAddr, asmWidths = true, addr, w
+	debugOutputChan <- fmt.Sprintf("Assembling at $%06X with %v, enter . to finish\n", addr, w)
+}
+
+// Assemble a line in the line assembler, writing it to the target and
+// moving on to the next address
+func debugAsmLine(t *neonTarget, words []string) {
+	line := strings.Join(words, " ")
+	if strings.TrimSpace(line) == "." {
+		asmActive = false
+		debugOutputChan <- "Assembler finished!\n"
+		return
+	}
+	code, err := assemble(asmAddr, line, asmWidths)
+	if err != nil {
+		debugOutputChan <- fmt.Sprintf("Assembly error: %v!\n", err)
+		return
+	}
+	if !debugReportError(t.WriteMemory(asmAddr, code)) {
+		return
+	}
+	listing, next := formatDisassembly(asmAddr, code, 1, &asmWidths)
+	debugOutputChan <- listing
+	asmAddr = next
+}
+
+// Read memory in chunks, optionally showing progress
+func debugReadMemory(t *neonTarget, addr uint32, n int, progress bool) ([]byte, bool) {
+	data := make([]byte, 0, n)
+	for idx := 0; idx < n; idx += 0x800 {
+		if progress {
+			debugProgress(idx, n)
+		}
+		buf, err := t.ReadMemory(addr+uint32(idx), imin(0x800, n-idx))
+		data = append(data, buf...)
+		if !debugReportError(err) {
+			return data, false
+		}
+	}
+	return data, true
+}
+
+// Separate --name and --name=value options from the other arguments,
+// complaining about any not in allowed.  Empty strings are dropped.
+func splitOptions(args []string, allowed ...string) (map[string]string, []string, bool) {
+	opts := make(map[string]string)
+	var rest []string
+	for _, a := range nonEmpty(args) {
+		if !strings.HasPrefix(a, "--") {
+			rest = append(rest, a)
+			continue
+		}
+		kv := strings.SplitN(a[2:], "=", 2)
+		name := strings.ToLower(kv[0])
+		known := false
+		for _, o := range allowed {
+			known = known || o == name
+		}
+		if !known {
+			debugOutputChan <- fmt.Sprintf("Unknown option: %s\n", a)
+			return nil, nil, false
+		}
+		opts[name] = ""
+		if len(kv) > 1 {
+			opts[name] = kv[1]
+		}
+	}
+	return opts, rest, true
+}
+
+// Force an address into the flash ROM address space
+func flashAddr(addr uint32) uint32 {
+	return flashBank<<16 | (addr & 0x0F_FFFF)
+}
+
+// Return args with empty strings removed
+func nonEmpty(args []string) []string {
+	var r []string
+	for _, a := range args {
+		if a != "" {
+			r = append(r, a)
+		}
+	}
+	return r
+}
+
+// Load a memory image file named by args[0], with an optional load address
+// in args[1].  For flash, a missing load address means the start of the ROM.
+func debugLoadImage(args []string, flash bool) ([]memSegment, bool) {
+	base, haveBase := uint32(0), flash
+	if len(args) > 1 && args[1] != "" {
+		var err error
+		base, err = parseAddr(args[1])
+		if err != nil {
+			debugOutputChan <- fmt.Sprintf("Bad address: %s\n", args[1])
+			return nil, false
+		}
+		haveBase = true
+	}
+	segments, format, err := loadImageFile(args[0], base, haveBase)
+	if err != nil {
+		debugOutputChan <- fmt.Sprintf("Could not load %s: %v\n", args[0], err)
+		return nil, false
+	}
+	debugOutputChan <- fmt.Sprintf("Loaded %s file %s\n", format.name, args[0])
+	return segments, true
+}
+
+// Identify the flash ROM, reporting if we can't or don't know the part
+func debugFlashChip(t *neonTarget) (*flashChip, bool) {
+	mfr, dev, err := t.ChipID(flashBank)
+	if !debugReportError(err) {
+		return nil, false
+	}
+	chip := findFlashChip(mfr, dev)
+	if chip == nil {
+		debugOutputChan <- fmt.Sprintf(
+			"Unknown flash ROM, manufacturer: %s, device: 0x%02X!\n",
+			flashMfrName(mfr), dev)
+		return nil, false
+	}
+	debugOutputChan <- fmt.Sprintf("Flash ROM is %v\n", chip)
+	return chip, true
+}
+
+// Check that segments fit in the flash ROM once forced into its range
+func debugCheckFit(chip *flashChip, segments []memSegment) bool {
+	for _, segment := range segments {
+		start := flashAddr(segment.Address) - flashBank<<16
+		end := start + uint32(len(segment.Data))
+		if end > chip.size {
+			debugOutputChan <- fmt.Sprintf(
+				"Image does not fit in %s, data at $%06X-$%06X!\n",
+				chip.name, start, end-1)
+			return false
+		}
+	}
+	return true
+}
+
+// Flash data at addr in chunks of an erased chip, showing progress
+func debugFlash(t *neonTarget, chip *flashChip, addr uint32, data []byte) bool {
+	for idx := 0; idx < len(data); idx += 0x800 {
+		debugProgress(idx, len(data))
+		end := imin(idx+0x800, len(data))
+		if !debugReportError(t.ProgramFlash(chip, addr+uint32(idx), data[idx:end], true)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Erase and reprogram only the flash sectors that segments touch.  The
+// existing contents of each sector are read first so that anything the
+// segments don't cover is put back, and sectors that would not change are
+// left alone.  Page written parts are done a page at a time with no erase,
+// since writing a page erases it.
+func debugFlashSectors(t *neonTarget, chip *flashChip, segments []memSegment) bool {
+	unit, what := chip.sectorSize, "sector"
+	if unit == 0 {
+		unit, what = chip.pageSize, "page"
+	}
+	if unit == 0 {
+		debugOutputChan <- fmt.Sprintf("%s has no sector erase!\n", chip.name)
+		return false
+	}
+	if !debugReportError(t.Stop()) {
+		return false
+	}
+	sectors := make(map[uint32][]byte)
+	original := make(map[uint32][]byte)
+	var order []uint32
+	for _, segment := range segments {
+		for i, b := range segment.Data {
+			a := flashAddr(segment.Address + uint32(i))
+			sa := a &^ (unit - 1)
+			sector, ok := sectors[sa]
+			if !ok {
+				var err error
+				sector, err = t.ReadMemory(sa, int(unit))
+				if !debugReportError(err) {
+					return false
+				}
+				sectors[sa] = sector
+				original[sa] = append([]byte(nil), sector...)
+				order = append(order, sa)
+			}
+			sector[a-sa] = b
+		}
+	}
+	sort.Slice(order, func(i, j int) bool { return order[i] < order[j] })
+	for n, sa := range order {
+		if bytes.Equal(sectors[sa], original[sa]) {
+			debugOutputChan <- fmt.Sprintf("Skipping %s %v of %v at $%06X, unchanged\n", what, n+1, len(order), sa)
+			continue
+		}
+		debugOutputChan <- fmt.Sprintf("Flashing %s %v of %v at $%06X\n", what, n+1, len(order), sa)
+		jobStatus("%s %v of %v", what, n+1, len(order))
+		if chip.sectorSize != 0 && !debugReportError(t.EraseSector(chip, sa)) {
+			return false
+		}
+		if !debugReportError(t.ProgramFlash(chip, sa, sectors[sa], chip.sectorSize != 0)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Compare memory at addr with data, adding any differences to report
+func debugVerify(t *neonTarget, report *verifyReport, addr uint32, data []byte, progress bool) bool {
+	for idx := 0; idx < len(data); idx += 0x800 {
+		if progress {
+			debugProgress(idx, len(data))
+		}
+		end := imin(idx+0x800, len(data))
+		buf, err := t.ReadMemory(addr+uint32(idx), end-idx)
+		report.compare(addr+uint32(idx), data[idx:end], buf)
+		if !debugReportError(err) {
+			return false
+		}
+	}
+	return true
+}
+
+// Report the outcome of a verify, saving the differences to diffFile if
+// it's not empty
+func debugVerifyDone(report *verifyReport, diffFile string) {
+	if len(report.ranges) == 0 {
+		debugOutputChan <- "Verify complete!\n"
+		return
+	}
+	debugOutputChan <- "Verify failed, " + report.summary()
+	if diffFile == "" {
+		return
+	}
+	if err := report.saveDiff(diffFile); err != nil {
+		debugOutputChan <- fmt.Sprintf("Could not save %s: %v\n", diffFile, err)
+		return
+	}
+	debugOutputChan <- fmt.Sprintf("Differences saved to %s\n", diffFile)
+}
+
+// Get back in step with the debug port, reporting anything discarded
+func debugResync(t *neonTarget) bool {
+	n, err := t.Sync()
+	if n > 0 {
+		debugOutputChan <- fmt.Sprintf("Discarded %v byte%s from debug device.\n", n, plural(n))
+	}
+	return debugReportError(err)
+}
+
+// Report reads retried since the last report
+func debugRetried(t *neonTarget) {
+	if t.retried > 0 {
+		debugOutputChan <- fmt.Sprintf("Retried %v read%s after debug port errors\n", t.retried, plural(t.retried))
+		t.retried = 0
 	}
-	return n
 }
@@ -0,0 +1,342 @@
+package main
+
+// 65816 disassembler
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Addressing modes
+type addrMode int
+
+const (
+	modeImp     addrMode = iota // implied
+	modeAcc                     // A
+	modeImmM                    // #$12 or #$1234 depending on M
+	modeImmX                    // #$12 or #$1234 depending on X
+	modeImm8                    // #$12
+	modeDp                      // $12
+	modeDpX                     // $12,X
+	modeDpY                     // $12,Y
+	modeDpInd                   // ($12)
+	modeDpIndX                  // ($12,X)
+	modeDpIndY                  // ($12),Y
+	modeDpIndL                  // [$12]
+	modeDpIndLY                 // [$12],Y
+	modeAbs                     // $1234
+	modeAbsX                    // $1234,X
+	modeAbsY                    // $1234,Y
+	modeAbsInd                  // ($1234)
+	modeAbsIndX                 // ($1234,X)
+	modeAbsIndL                 // [$1234]
+	modeLong                    // $123456
+	modeLongX                   // $123456,X
+	modeRel                     // 8-bit branch offset
+	modeRelL                    // 16-bit branch offset
+	modeSr                      // $12,S
+	modeSrIndY                  // ($12,S),Y
+	modeBlk                     // $12,$34 source and destination banks
+)
+
+// Operand syntax for each mode, %s being the value
+var modeSyntax = [...]string{
+	modeImp:     "",
+	modeAcc:     "A",
+	modeImmM:    "#%s",
+	modeImmX:    "#%s",
+	modeImm8:    "#%s",
+	modeDp:      "%s",
+	modeDpX:     "%s,X",
+	modeDpY:     "%s,Y",
+	modeDpInd:   "(%s)",
+	modeDpIndX:  "(%s,X)",
+	modeDpIndY:  "(%s),Y",
+	modeDpIndL:  "[%s]",
+	modeDpIndLY: "[%s],Y",
+	modeAbs:     "%s",
+	modeAbsX:    "%s,X",
+	modeAbsY:    "%s,Y",
+	modeAbsInd:  "(%s)",
+	modeAbsIndX: "(%s,X)",
+	modeAbsIndL: "[%s]",
+	modeLong:    "%s",
+	modeLongX:   "%s,X",
+	modeRel:     "%s",
+	modeRelL:    "%s",
+	modeSr:      "%s,S",
+	modeSrIndY:  "(%s,S),Y",
+	modeBlk:     "%s",
+}
+
+// An instruction
+type opcode struct {
+	mnem string
+	mode addrMode
+}
+
+// The 65816 instruction set, by opcode
+var opcodes = [256]opcode{
+	// $00
+	{"BRK", modeImm8}, {"ORA", modeDpIndX}, {"COP", modeImm8}, {"ORA", modeSr},
+	{"TSB", modeDp}, {"ORA", modeDp}, {"ASL", modeDp}, {"ORA", modeDpIndL},
+	{"PHP", modeImp}, {"ORA", modeImmM}, {"ASL", modeAcc}, {"PHD", modeImp},
+	{"TSB", modeAbs}, {"ORA", modeAbs}, {"ASL", modeAbs}, {"ORA", modeLong},
+	// $10
+	{"BPL", modeRel}, {"ORA", modeDpIndY}, {"ORA", modeDpInd}, {"ORA", modeSrIndY},
+	{"TRB", modeDp}, {"ORA", modeDpX}, {"ASL", modeDpX}, {"ORA", modeDpIndLY},
+	{"CLC", modeImp}, {"ORA", modeAbsY}, {"INC", modeAcc}, {"TCS", modeImp},
+	{"TRB", modeAbs}, {"ORA", modeAbsX}, {"ASL", modeAbsX}, {"ORA", modeLongX},
+	// $20
+	{"JSR", modeAbs}, {"AND", modeDpIndX}, {"JSL", modeLong}, {"AND", modeSr},
+	{"BIT", modeDp}, {"AND", modeDp}, {"ROL", modeDp}, {"AND", modeDpIndL},
+	{"PLP", modeImp}, {"AND", modeImmM}, {"ROL", modeAcc}, {"PLD", modeImp},
+	{"BIT", modeAbs}, {"AND", modeAbs}, {"ROL", modeAbs}, {"AND", modeLong},
+	// $30
+	{"BMI", modeRel}, {"AND", modeDpIndY}, {"AND", modeDpInd}, {"AND", modeSrIndY},
+	{"BIT", modeDpX}, {"AND", modeDpX}, {"ROL", modeDpX}, {"AND", modeDpIndLY},
+	{"SEC", modeImp}, {"AND", modeAbsY}, {"DEC", modeAcc}, {"TSC", modeImp},
+	{"BIT", modeAbsX}, {"AND", modeAbsX}, {"ROL", modeAbsX}, {"AND", modeLongX},
+	// $40
+	{"RTI", modeImp}, {"EOR", modeDpIndX}, {"WDM", modeImm8}, {"EOR", modeSr},
+	{"MVP", modeBlk}, {"EOR", modeDp}, {"LSR", modeDp}, {"EOR", modeDpIndL},
+	{"PHA", modeImp}, {"EOR", modeImmM}, {"LSR", modeAcc}, {"PHK", modeImp},
+	{"JMP", modeAbs}, {"EOR", modeAbs}, {"LSR", modeAbs}, {"EOR", modeLong},
+	// $50
+	{"BVC", modeRel}, {"EOR", modeDpIndY}, {"EOR", modeDpInd}, {"EOR", modeSrIndY},
+	{"MVN", modeBlk}, {"EOR", modeDpX}, {"LSR", modeDpX}, {"EOR", modeDpIndLY},
+	{"CLI", modeImp}, {"EOR", modeAbsY}, {"PHY", modeImp}, {"TCD", modeImp},
+	{"JML", modeLong}, {"EOR", modeAbsX}, {"LSR", modeAbsX}, {"EOR", modeLongX},
+	// $60
+	{"RTS", modeImp}, {"ADC", modeDpIndX}, {"PER", modeRelL}, {"ADC", modeSr},
+	{"STZ", modeDp}, {"ADC", modeDp}, {"ROR", modeDp}, {"ADC", modeDpIndL},
+	{"PLA", modeImp}, {"ADC", modeImmM}, {"ROR", modeAcc}, {"RTL", modeImp},
+	{"JMP", modeAbsInd}, {"ADC", modeAbs}, {"ROR", modeAbs}, {"ADC", modeLong},
+	// $70
+	{"BVS", modeRel}, {"ADC", modeDpIndY}, {"ADC", modeDpInd}, {"ADC", modeSrIndY},
+	{"STZ", modeDpX}, {"ADC", modeDpX}, {"ROR", modeDpX}, {"ADC", modeDpIndLY},
+	{"SEI", modeImp}, {"ADC", modeAbsY}, {"PLY", modeImp}, {"TDC", modeImp},
+	{"JMP", modeAbsIndX}, {"ADC", modeAbsX}, {"ROR", modeAbsX}, {"ADC", modeLongX},
+	// $80
+	{"BRA", modeRel}, {"STA", modeDpIndX}, {"BRL", modeRelL}, {"STA", modeSr},
+	{"STY", modeDp}, {"STA", modeDp}, {"STX", modeDp}, {"STA", modeDpIndL},
+	{"DEY", modeImp}, {"BIT", modeImmM}, {"TXA", modeImp}, {"PHB", modeImp},
+	{"STY", modeAbs}, {"STA", modeAbs}, {"STX", modeAbs}, {"STA", modeLong},
+	// $90
+	{"BCC", modeRel}, {"STA", modeDpIndY}, {"STA", modeDpInd}, {"STA", modeSrIndY},
+	{"STY", modeDpX}, {"STA", modeDpX}, {"STX", modeDpY}, {"STA", modeDpIndLY},
+	{"TYA", modeImp}, {"STA", modeAbsY}, {"TXS", modeImp}, {"TXY", modeImp},
+	{"STZ", modeAbs}, {"STA", modeAbsX}, {"STZ", modeAbsX}, {"STA", modeLongX},
+	// $A0
+	{"LDY", modeImmX}, {"LDA", modeDpIndX}, {"LDX", modeImmX}, {"LDA", modeSr},
+	{"LDY", modeDp}, {"LDA", modeDp}, {"LDX", modeDp}, {"LDA", modeDpIndL},
+	{"TAY", modeImp}, {"LDA", modeImmM}, {"TAX", modeImp}, {"PLB", modeImp},
+	{"LDY", modeAbs}, {"LDA", modeAbs}, {"LDX", modeAbs}, {"LDA", modeLong},
+	// $B0
+	{"BCS", modeRel}, {"LDA", modeDpIndY}, {"LDA", modeDpInd}, {"LDA", modeSrIndY},
+	{"LDY", modeDpX}, {"LDA", modeDpX}, {"LDX", modeDpY}, {"LDA", modeDpIndLY},
+	{"CLV", modeImp}, {"LDA", modeAbsY}, {"TSX", modeImp}, {"TYX", modeImp},
+	{"LDY", modeAbsX}, {"LDA", modeAbsX}, {"LDX", modeAbsY}, {"LDA", modeLongX},
+	// $C0
+	{"CPY", modeImmX}, {"CMP", modeDpIndX}, {"REP", modeImm8}, {"CMP", modeSr},
+	{"CPY", modeDp}, {"CMP", modeDp}, {"DEC", modeDp}, {"CMP", modeDpIndL},
+	{"INY", modeImp}, {"CMP", modeImmM}, {"DEX", modeImp}, {"WAI", modeImp},
+	{"CPY", modeAbs}, {"CMP", modeAbs}, {"DEC", modeAbs}, {"CMP", modeLong},
+	// $D0
+	{"BNE", modeRel}, {"CMP", modeDpIndY}, {"CMP", modeDpInd}, {"CMP", modeSrIndY},
+	{"PEI", modeDpInd}, {"CMP", modeDpX}, {"DEC", modeDpX}, {"CMP", modeDpIndLY},
+	{"CLD", modeImp}, {"CMP", modeAbsY}, {"PHX", modeImp}, {"STP", modeImp},
+	{"JML", modeAbsIndL}, {"CMP", modeAbsX}, {"DEC", modeAbsX}, {"CMP", modeLongX},
+	// $E0
+	{"CPX", modeImmX}, {"SBC", modeDpIndX}, {"SEP", modeImm8}, {"SBC", modeSr},
+	{"CPX", modeDp}, {"SBC", modeDp}, {"INC", modeDp}, {"SBC", modeDpIndL},
+	{"INX", modeImp}, {"SBC", modeImmM}, {"NOP", modeImp}, {"XBA", modeImp},
+	{"CPX", modeAbs}, {"SBC", modeAbs}, {"INC", modeAbs}, {"SBC", modeLong},
+	// $F0
+	{"BEQ", modeRel}, {"SBC", modeDpIndY}, {"SBC", modeDpInd}, {"SBC", modeSrIndY},
+	{"PEA", modeAbs}, {"SBC", modeDpX}, {"INC", modeDpX}, {"SBC", modeDpIndLY},
+	{"SED", modeImp}, {"SBC", modeAbsY}, {"PLX", modeImp}, {"XCE", modeImp},
+	{"JSR", modeAbsIndX}, {"SBC", modeAbsX}, {"INC", modeAbsX}, {"SBC", modeLongX},
+}
+
+// Register widths and mode of the CPU, as far as the disassembler can tell
+// by following the code.  carry is only tracked to see which way XCE goes.
+type cpuWidths struct {
+	m8, x8 bool // 8-bit accumulator and index registers
+	e      bool // emulation mode
+	carry  int  // 0 clear, 1 set, -1 unknown
+}
+
+// The widths assumed when none are given: native mode with 8-bit registers,
+// as CLC, XCE leaves the CPU after reset
+func defaultWidths() cpuWidths {
+	return cpuWidths{m8: true, x8: true, carry: -1}
+}
+
+// Describe the widths for the user
+func (w cpuWidths) String() string {
+	if w.e {
+		return "E=1"
+	}
+	m, x := 16, 16
+	if w.m8 {
+		m = 8
+	}
+	if w.x8 {
+		x = 8
+	}
+	return fmt.Sprintf("M=%v X=%v", m, x)
+}
+
+// Return the number of operand bytes for mode
+func (mode addrMode) operandSize(w cpuWidths) int {
+	switch mode {
+	case modeImp, modeAcc:
+		return 0
+	case modeImmM:
+		if w.m8 {
+			return 1
+		}
+		return 2
+	case modeImmX:
+		if w.x8 {
+			return 1
+		}
+		return 2
+	case modeAbs, modeAbsX, modeAbsY, modeAbsInd, modeAbsIndX, modeAbsIndL,
+		modeRelL, modeBlk:
+		return 2
+	case modeLong, modeLongX:
+		return 3
+	}
+	return 1
+}
+
+// Update the widths for the effect of an instruction
+func (w *cpuWidths) follow(op byte, operand uint32) {
+	switch op {
+	case 0x18: // CLC
+		w.carry = 0
+	case 0x38: // SEC
+		w.carry = 1
+	case 0xC2: // REP
+		if !w.e {
+			w.m8 = w.m8 && operand&0x20 == 0
+			w.x8 = w.x8 && operand&0x10 == 0
+		}
+		if operand&0x01 != 0 {
+			w.carry = 0
+		}
+	case 0xE2: // SEP
+		w.m8 = w.m8 || operand&0x20 != 0
+		w.x8 = w.x8 || operand&0x10 != 0
+		if operand&0x01 != 0 {
+			w.carry = 1
+		}
+	case 0xFB: // XCE swaps carry and emulation mode
+		if w.carry < 0 {
+			break
+		}
+		e := w.carry == 1
+		w.carry = 0
+		if w.e {
+			w.carry = 1
+		}
+		w.e = e
+		if e {
+			w.m8, w.x8 = true, true
+		}
+	case 0x28, 0x40: // PLP, RTI
+		w.carry = -1
+	}
+}
+
+// Disassemble the instruction at the start of code, which is at addr,
+// returning its text and length and updating w.  If code is too short the
+// length is 0.
+func disassemble(addr uint32, code []byte, w *cpuWidths) (string, int) {
+	if len(code) == 0 {
+		return "", 0
+	}
+	op := opcodes[code[0]]
+	n := 1 + op.mode.operandSize(*w)
+	if len(code) < n {
+		return "", 0
+	}
+	operand := uint32(0)
+	for i := n - 1; i > 0; i-- {
+		operand = operand<<8 | uint32(code[i])
+	}
+	// target is the address the operand refers to, for symbols
+	var value string
+	target, haveTarget := operand, true
+	switch op.mode {
+	case modeImp, modeAcc, modeImmM, modeImmX, modeImm8, modeSr, modeSrIndY:
+		haveTarget = false
+	case modeRel:
+		// branches stay within the bank
+		target = addr&0xFF_0000 | (addr+2+uint32(int8(operand)))&0xFFFF
+		value = fmt.Sprintf("$%04X", target&0xFFFF)
+	case modeRelL:
+		target = addr&0xFF_0000 | (addr+3+uint32(int16(operand)))&0xFFFF
+		value = fmt.Sprintf("$%04X", target&0xFFFF)
+	case modeBlk:
+		// the destination bank comes first in the code, but last in the text
+		value = fmt.Sprintf("$%02X,$%02X", code[2], code[1])
+		haveTarget = false
+	case modeAbs, modeAbsIndX:
+		if op.mnem == "JMP" || op.mnem == "JSR" {
+			target |= addr & 0xFF_0000 // in the program bank
+		}
+	}
+	if value == "" {
+		value = fmt.Sprintf("$%0*X", 2*(n-1), operand)
+	}
+	text := op.mnem
+	switch op.mode {
+	case modeImp:
+	case modeAcc:
+		text += " A"
+	default:
+		text += " " + fmt.Sprintf(modeSyntax[op.mode], value)
+	}
+	if haveTarget {
+		name := symbols.describe(target)
+		if n == 2 && op.mode != modeRel {
+			// direct page, only exact matches are likely to be right
+			name = symbols.at(target)
+		}
+		if name != "" {
+			text += "  ; " + name
+		}
+	}
+	w.follow(code[0], operand)
+	return text, n
+}
+
+// Format a listing of up to count instructions from code, which was read
+// from addr, returning it and the address following the last instruction
+func formatDisassembly(addr uint32, code []byte, count int, w *cpuWidths) (string, uint32) {
+	var sb strings.Builder
+	for i := 0; i < count; i++ {
+		text, n := disassemble(addr, code, w)
+		if n == 0 {
+			break
+		}
+		if name := symbols.at(addr); name != "" {
+			sb.WriteString(name + ":\n")
+		}
+		sb.WriteString(fmt.Sprintf("%06X  ", addr))
+		for j := 0; j < 4; j++ {
+			if j < n {
+				sb.WriteString(fmt.Sprintf("%02X ", code[j]))
+			} else {
+				sb.WriteString("   ")
+			}
+		}
+		sb.WriteString(" " + text + "\n")
+		addr += uint32(n)
+		code = code[n:]
+	}
+	return sb.String(), addr
+}
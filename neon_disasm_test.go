@@ -0,0 +1,89 @@
+package main
+
+import "testing"
+
+func TestDisassemble(t *testing.T) {
+	m16 := cpuWidths{x8: true, carry: -1}
+	x16 := cpuWidths{m8: true, carry: -1}
+	tests := []struct {
+		addr uint32
+		code []byte
+		w    cpuWidths
+		want string
+		n    int
+	}{
+		{0x1000, []byte{0xEA}, defaultWidths(), "NOP", 1},
+		{0x1000, []byte{0x0A}, defaultWidths(), "ASL A", 1},
+		{0x1000, []byte{0xA9, 0x12, 0x34}, defaultWidths(), "LDA #$12", 2},
+		{0x1000, []byte{0xA9, 0x12, 0x34}, m16, "LDA #$3412", 3},
+		{0x1000, []byte{0xA2, 0x12, 0x34}, m16, "LDX #$12", 2},
+		{0x1000, []byte{0xA2, 0x12, 0x34}, x16, "LDX #$3412", 3},
+		{0x1000, []byte{0xC2, 0x30}, defaultWidths(), "REP #$30", 2},
+		{0x1000, []byte{0xB1, 0x10}, defaultWidths(), "LDA ($10),Y", 2},
+		{0x1000, []byte{0xB7, 0x10}, defaultWidths(), "LDA [$10],Y", 2},
+		{0x1000, []byte{0xB3, 0x03}, defaultWidths(), "LDA ($03,S),Y", 2},
+		{0x1000, []byte{0xBD, 0x00, 0x20}, defaultWidths(), "LDA $2000,X", 3},
+		{0x1000, []byte{0xBF, 0x56, 0x34, 0x12}, defaultWidths(), "LDA $123456,X", 4},
+		{0x1000, []byte{0x7C, 0x00, 0x20}, defaultWidths(), "JMP ($2000,X)", 3},
+		{0x1000, []byte{0xDC, 0x00, 0x20}, defaultWidths(), "JML [$2000]", 3},
+		{0x12_1000, []byte{0xD0, 0xFE}, defaultWidths(), "BNE $1000", 2},
+		{0x12_FFF0, []byte{0x80, 0x20}, defaultWidths(), "BRA $0012", 2},
+		{0x1000, []byte{0x82, 0xFD, 0xFF}, defaultWidths(), "BRL $1000", 3},
+		{0x1000, []byte{0x54, 0x12, 0x34}, defaultWidths(), "MVN $34,$12", 3},
+		// too short for the operand
+		{0x1000, []byte{0xAD, 0x00}, defaultWidths(), "", 0},
+		{0x1000, nil, defaultWidths(), "", 0},
+	}
+	for _, tt := range tests {
+		w := tt.w
+		text, n := disassemble(tt.addr, tt.code, &w)
+		if text != tt.want || n != tt.n {
+			t.Errorf("% X at $%06X (%v): got %q, %v, want %q, %v", tt.code, tt.addr, tt.w, text, n, tt.want, tt.n)
+		}
+	}
+}
+
+func TestDisassembleWidths(t *testing.T) {
+	tests := []struct {
+		code []byte
+		want string
+	}{
+		{[]byte{0xC2, 0x30}, "M=16 X=16"},                        // REP #$30
+		{[]byte{0xC2, 0x30, 0xE2, 0x20}, "M=8 X=16"},             // then SEP #$20
+		{[]byte{0x38, 0xFB}, "E=1"},                              // SEC, XCE
+		{[]byte{0x38, 0xFB, 0xC2, 0x30}, "E=1"},                  // REP can't widen in emulation mode
+		{[]byte{0x38, 0xFB, 0x18, 0xFB}, "M=8 X=8"},              // and back with CLC, XCE
+		{[]byte{0x38, 0x28, 0xFB}, "M=8 X=8"},                    // PLP leaves carry unknown
+		{[]byte{0x38, 0xFB, 0x18, 0xFB, 0xC2, 0x10}, "M=8 X=16"}, // native again, REP #$10
+	}
+	for _, tt := range tests {
+		w := defaultWidths()
+		for code := tt.code; len(code) > 0; {
+			_, n := disassemble(0x1000, code, &w)
+			if n == 0 {
+				t.Fatalf("% X: stopped at % X", tt.code, code)
+			}
+			code = code[n:]
+		}
+		if got := w.String(); got != tt.want {
+			t.Errorf("% X: widths %s, want %s", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestFormatDisassembly(t *testing.T) {
+	saved := symbols
+	defer func() { symbols = saved }()
+	symbols = newSymbolTable()
+	symbols.add("start", 0x1000)
+	symbols.add("buffer", 0x2000)
+	code := []byte{0xAD, 0x01, 0x20, 0x80, 0xFB, 0xEA}
+	got, next := formatDisassembly(0x1000, code, 10, &cpuWidths{m8: true, x8: true, carry: -1})
+	want := "start:\n" +
+		"001000  AD 01 20     LDA $2001  ; buffer+$1\n" +
+		"001003  80 FB        BRA $1000  ; start\n" +
+		"001005  EA           NOP\n"
+	if got != want || next != 0x1006 {
+		t.Errorf("listing\n%s\nnext $%06X, want\n%s\nnext $001006", got, next, want)
+	}
+}
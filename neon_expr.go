@@ -0,0 +1,231 @@
+package main
+
+// Address and data expressions
+
+// Expressions are made of numbers, symbols, parentheses and the operators
+// below, loosest binding first:
+//   |
+//   &
+//   << >>
+//   + -
+//   * /
+//   unary - ~
+// Numbers are $hex, %binary, 0x hex or decimal.  Addresses can also be
+// written with their bank as $20:8000 or, like the IIgs monitor, 20/8000,
+// where plain digits are hex.
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Bank and offset addresses
+var (
+	bankColonRegexp = regexp.MustCompile(`^\$?([0-9A-Fa-f]{1,2}):\$?([0-9A-Fa-f]{1,4})`)
+	bankSlashRegexp = regexp.MustCompile(`^([0-9A-Fa-f]{2})/([0-9A-Fa-f]{4})`)
+)
+
+// Expression parser state
+type exprParser struct {
+	s        string // expression
+	pos      int    // next character
+	size     int    // bytes the widest number was written with
+	symbolic bool   // a symbol was used
+}
+
+// Evaluate an expression
+func evalExpr(s string) (int64, error) {
+	v, _, err := evalExprSized(s)
+	return v, err
+}
+
+// Evaluate an expression, also returning how many bytes it was written
+// with so that the assembler can tell $0012 from $12.  The size is 0 if a
+// symbol was used, since it then depends on where the value is used.
+func evalExprSized(s string) (int64, int, error) {
+	p := &exprParser{s: s}
+	v, err := p.binary(0)
+	if err == nil && p.pos < len(p.s) {
+		err = fmt.Errorf("unexpected %q", p.s[p.pos:])
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	size := p.size
+	if size == 0 {
+		size = 1
+	}
+	for v > 0 && v>>(8*uint(size)) != 0 {
+		size++
+	}
+	if p.symbolic {
+		size = 0
+	}
+	return v, size, nil
+}
+
+// Binary operators by precedence, loosest first
+var exprOperators = [][]string{
+	{"|"},
+	{"&"},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*", "/"},
+}
+
+// Parse operators of the given precedence and tighter
+func (p *exprParser) binary(level int) (int64, error) {
+	if level == len(exprOperators) {
+		return p.unary()
+	}
+	v, err := p.binary(level + 1)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		op := ""
+		for _, o := range exprOperators[level] {
+			if strings.HasPrefix(p.s[p.pos:], o) {
+				op = o
+			}
+		}
+		if op == "" {
+			return v, nil
+		}
+		p.pos += len(op)
+		r, err := p.binary(level + 1)
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case "|":
+			v |= r
+		case "&":
+			v &= r
+		case "<<":
+			v <<= uint(r & 63)
+		case ">>":
+			v >>= uint(r & 63)
+		case "+":
+			v += r
+		case "-":
+			v -= r
+		case "*":
+			v *= r
+		case "/":
+			if r == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			v /= r
+		}
+	}
+}
+
+// Parse a unary operator or a primary value
+func (p *exprParser) unary() (int64, error) {
+	if p.pos < len(p.s) {
+		switch p.s[p.pos] {
+		case '-':
+			p.pos++
+			v, err := p.unary()
+			return -v, err
+		case '~':
+			p.pos++
+			v, err := p.unary()
+			return ^v, err
+		}
+	}
+	return p.primary()
+}
+
+// Parse a number, symbol or parenthesized expression
+func (p *exprParser) primary() (int64, error) {
+	rest := p.s[p.pos:]
+	if rest == "" {
+		return 0, fmt.Errorf("missing value")
+	}
+	for _, re := range []*regexp.Regexp{bankColonRegexp, bankSlashRegexp} {
+		if m := re.FindStringSubmatch(rest); m != nil {
+			bank, _ := strconv.ParseUint(m[1], 16, 8)
+			offset, _ := strconv.ParseUint(m[2], 16, 16)
+			p.pos += len(m[0])
+			p.sized(3)
+			return int64(bank<<16 | offset), nil
+		}
+	}
+	c := rest[0]
+	switch {
+	case c == '(':
+		p.pos++
+		v, err := p.binary(0)
+		if err != nil {
+			return 0, err
+		}
+		if p.pos >= len(p.s) || p.s[p.pos] != ')' {
+			return 0, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return v, nil
+	case c == '$':
+		digits := p.token(1)
+		v, err := strconv.ParseUint(digits, 16, 32)
+		if err != nil {
+			return 0, fmt.Errorf("bad number $%s", digits)
+		}
+		p.sized((len(digits) + 1) / 2)
+		return int64(v), nil
+	case c == '%':
+		digits := p.token(1)
+		v, err := strconv.ParseUint(digits, 2, 32)
+		if err != nil {
+			return 0, fmt.Errorf("bad number %%%s", digits)
+		}
+		return int64(v), nil
+	case c >= '0' && c <= '9':
+		digits := p.token(0)
+		// not base 0, which would make a leading 0 octal
+		text, base := digits, 10
+		if strings.HasPrefix(strings.ToLower(digits), "0x") {
+			text, base = digits[2:], 16
+		}
+		v, err := strconv.ParseUint(text, base, 32)
+		if err != nil {
+			return 0, fmt.Errorf("bad number %s", digits)
+		}
+		return int64(v), nil
+	case isSymbolChar(c):
+		name := p.token(0)
+		addr, ok := symbols.lookup(name)
+		if !ok {
+			return 0, fmt.Errorf("unknown symbol %s", name)
+		}
+		p.symbolic = true
+		return int64(addr), nil
+	}
+	return 0, fmt.Errorf("unexpected %q", rest)
+}
+
+// Skip skip characters, then return the symbol characters that follow
+func (p *exprParser) token(skip int) string {
+	p.pos += skip
+	start := p.pos
+	for p.pos < len(p.s) && isSymbolChar(p.s[p.pos]) {
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+
+// Note that a number was written with n bytes
+func (p *exprParser) sized(n int) {
+	if n > p.size {
+		p.size = n
+	}
+}
+
+// Return true if c can be part of a symbol or number
+func isSymbolChar(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' ||
+		c == '_' || c == '@' || c == '.'
+}
@@ -0,0 +1,78 @@
+package main
+
+import "testing"
+
+func TestEvalExpr(t *testing.T) {
+	saved := symbols
+	defer func() { symbols = saved }()
+	symbols = newSymbolTable()
+	symbols.add("main", 0x12_8000)
+	symbols.add("zp.ptr", 0x10)
+	tests := []struct {
+		expr string
+		want int64
+		size int
+	}{
+		{"$12", 0x12, 1},
+		{"$0012", 0x12, 2},
+		{"$ff", 0xFF, 1},
+		{"%1010", 10, 1},
+		{"42", 42, 1},
+		{"010", 10, 1},
+		{"0x1234", 0x1234, 2},
+		{"1000", 1000, 2},
+		{"$20:8000", 0x20_8000, 3},
+		{"20:8000", 0x20_8000, 3},
+		{"0:12", 0x12, 3},
+		{"20/8000", 0x20_8000, 3},
+		{"$20:8000+$10", 0x20_8010, 3},
+		{"1+2*3", 7, 1},
+		{"(1+2)*3", 9, 1},
+		{"10-4-3", 3, 1},
+		{"100/7/2", 7, 1},
+		{"1<<8|1", 0x101, 2},
+		{"$1234>>8&$F", 2, 2},
+		{"-1", -1, 1},
+		{"~0&$FF", 0xFF, 1},
+		{"--3", 3, 1},
+		{"main", 0x12_8000, 0},
+		{"MAIN+4", 0x12_8004, 0},
+		{"zp.ptr", 0x10, 0},
+		{"main>>16", 0x12, 0},
+	}
+	for _, tt := range tests {
+		v, size, err := evalExprSized(tt.expr)
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+			continue
+		}
+		if v != tt.want || size != tt.size {
+			t.Errorf("%s: got $%X size %v, want $%X size %v", tt.expr, v, size, tt.want, tt.size)
+		}
+	}
+}
+
+func TestEvalExprErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		err  string
+	}{
+		{"", "missing value"},
+		{"1+", "missing value"},
+		{"(1+2", "missing )"},
+		{"1)", `unexpected ")"`},
+		{"$", "bad number $"},
+		{"$12G", "bad number $12G"},
+		{"%102", "bad number %102"},
+		{"12ab", "bad number 12ab"},
+		{"1/0", "division by zero"},
+		{"nothing", "unknown symbol nothing"},
+		{"1 + 2", `unexpected " + 2"`},
+		{"#1", `unexpected "#1"`},
+	}
+	for _, tt := range tests {
+		if _, err := evalExpr(tt.expr); err == nil || err.Error() != tt.err {
+			t.Errorf("%q: error %v, want %s", tt.expr, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+// Memory image files
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/marcinbor85/gohex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A contiguous run of data to load at an address
+type memSegment struct {
+	Address uint32
+	Data    []byte
+}
+
+// A loader takes the contents of a file and a load address, and whether one
+// was given, which only formats that need or can use one pay attention to
+type imageLoader func(data []byte, base uint32, haveBase bool) ([]memSegment, error)
+
+// A loadable file format
+type imageFormat struct {
+	name     string                 // for messages
+	exts     []string               // file name extensions
+	detect   func(data []byte) bool // content sniffer
+	needBase bool                   // load address required
+	load     imageLoader            // loader
+}
+
+// Supported formats, in order of detection.  Raw binary must be last since it
+// accepts anything.
+var imageFormats = []*imageFormat{
+	{
+		name:   "Intel hex",
+		exts:   []string{".hex", ".ihx", ".ihex"},
+		detect: func(data []byte) bool { return len(data) > 0 && data[0] == ':' },
+		load:   loadIntelHex,
+	},
+	{
+		name: "S-record",
+		exts: []string{".srec", ".s19", ".s28", ".s37", ".mot"},
+		detect: func(data []byte) bool {
+			return len(data) > 1 && data[0] == 'S' && data[1] >= '0' && data[1] <= '9'
+		},
+		load: loadSRecord,
+	},
+	{
+		name:   "o65",
+		exts:   []string{".o65"},
+		detect: func(data []byte) bool { return bytes.HasPrefix(data, o65Magic) },
+		load:   loadO65,
+	},
+	{
+		name:     "binary",
+		exts:     []string{".bin", ".rom", ".img"},
+		detect:   func(data []byte) bool { return true },
+		needBase: true,
+		load:     loadBinary,
+	},
+}
+
+// Work out the format of a file from its name, or failing that its contents
+func detectImageFormat(name string, data []byte) *imageFormat {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, f := range imageFormats {
+		for _, e := range f.exts {
+			if e == ext {
+				return f
+			}
+		}
+	}
+	for _, f := range imageFormats {
+		if f.detect(data) {
+			return f
+		}
+	}
+	return nil
+}
+
+// Load an Intel hex file
+func loadIntelHex(data []byte, base uint32, haveBase bool) ([]memSegment, error) {
+	mem := gohex.NewMemory()
+	if err := mem.ParseIntelHex(bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	var segs []memSegment
+	for _, s := range mem.GetDataSegments() {
+		segs = append(segs, memSegment{Address: s.Address, Data: s.Data})
+	}
+	return segs, nil
+}
+
+// Load a Motorola S-record file
+func loadSRecord(data []byte, base uint32, haveBase bool) ([]memSegment, error) {
+	var segs []memSegment
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if len(line) < 4 || line[0] != 'S' {
+			return nil, fmt.Errorf("line %v: not an S-record", n+1)
+		}
+		rec, err := hex.DecodeString(line[2:])
+		if err != nil || len(rec) < 1 || int(rec[0]) != len(rec)-1 {
+			return nil, fmt.Errorf("line %v: malformed record", n+1)
+		}
+		sum := byte(0)
+		for _, b := range rec {
+			sum += b
+		}
+		if sum != 0xFF {
+			return nil, fmt.Errorf("line %v: bad checksum", n+1)
+		}
+		rec = rec[1 : len(rec)-1] // drop count and checksum
+		alen := 0
+		switch line[1] {
+		case '1':
+			alen = 2
+		case '2':
+			alen = 3
+		case '3':
+			alen = 4
+		default:
+			// header, count and start address records carry no data
+			continue
+		}
+		if len(rec) < alen {
+			return nil, fmt.Errorf("line %v: malformed record", n+1)
+		}
+		addr := uint32(0)
+		for _, b := range rec[:alen] {
+			addr = addr<<8 | uint32(b)
+		}
+		segs = addSegment(segs, addr, rec[alen:])
+	}
+	return sortSegments(segs)
+}
+
+// o65 files start with this
+var o65Magic = []byte{0x01, 0x00, 'o', '6', '5', 0x00}
+
+// o65 mode bits
+const (
+	o65ModePage = 0x4000 // pagewise relocation
+	o65ModeLong = 0x2000 // 32-bit sizes
+)
+
+// o65 relocation types
+const (
+	o65RelocLow    = 0x20
+	o65RelocHigh   = 0x40
+	o65RelocWord   = 0x80
+	o65RelocSeg    = 0xA0
+	o65RelocSegAdr = 0xC0
+)
+
+// Reader for the fields of an o65 file
+type o65Reader struct {
+	data []byte
+	pos  int
+	long bool // sizes are 32 bits
+	err  error
+}
+
+func (r *o65Reader) byte() int {
+	if r.pos >= len(r.data) {
+		if r.err == nil {
+			r.err = fmt.Errorf("o65 file truncated")
+		}
+		return 0
+	}
+	r.pos++
+	return int(r.data[r.pos-1])
+}
+
+func (r *o65Reader) word() uint32 {
+	return uint32(r.byte()) | uint32(r.byte())<<8
+}
+
+func (r *o65Reader) size() uint32 {
+	if r.long {
+		return r.word() | r.word()<<16
+	}
+	return r.word()
+}
+
+func (r *o65Reader) bytes(n uint32) []byte {
+	if r.err != nil || uint32(len(r.data)-r.pos) < n {
+		if r.err == nil {
+			r.err = fmt.Errorf("o65 file truncated")
+		}
+		return make([]byte, n)
+	}
+	r.pos += int(n)
+	return append([]byte(nil), r.data[r.pos-int(n):r.pos]...)
+}
+
+// Load an o65 relocatable object.  The text segment is relocated to base if
+// one was given, with data following it.  Otherwise the segments are loaded
+// where the file says.  Only the first file of a chain is loaded, and files
+// with undefined references are refused since there is nothing to link them
+// with.
+func loadO65(data []byte, base uint32, haveBase bool) ([]memSegment, error) {
+	r := &o65Reader{data: data, pos: len(o65Magic)}
+	mode := r.word()
+	r.long = mode&o65ModeLong != 0
+	tbase, tlen := r.size(), r.size()
+	dbase, dlen := r.size(), r.size()
+	bbase, _ := r.size(), r.size()
+	r.size() // zbase
+	r.size() // zlen
+	r.size() // stack
+	// skip header options
+	for olen := r.byte(); olen != 0 && r.err == nil; olen = r.byte() {
+		r.bytes(uint32(olen) - 1)
+	}
+	text := r.bytes(tlen)
+	dat := r.bytes(dlen)
+	if undef := r.size(); undef != 0 {
+		return nil, fmt.Errorf("o65 file has %v undefined references", undef)
+	}
+	// work out where everything goes
+	newT, newD, newB := tbase, dbase, bbase
+	if haveBase {
+		newT = base
+		newD = newT + tlen
+		newB = newD + dlen
+	}
+	delta := map[int]uint32{
+		1: 0,            // absolute
+		2: newT - tbase, // text
+		3: newD - dbase, // data
+		4: newB - bbase, // bss
+		5: 0,            // zero page stays put
+	}
+	for _, seg := range []struct {
+		mem  []byte
+		base uint32
+	}{{text, tbase}, {dat, dbase}} {
+		addr := seg.base - 1
+		for off := r.byte(); off != 0 && r.err == nil; off = r.byte() {
+			if off == 255 {
+				addr += 254
+				continue
+			}
+			addr += uint32(off)
+			typ := r.byte()
+			segID := typ & 0x1F
+			if segID == 0 {
+				return nil, fmt.Errorf("o65 relocation to undefined reference")
+			}
+			d, ok := delta[segID]
+			if !ok {
+				return nil, fmt.Errorf("o65 relocation to unknown segment %v", segID)
+			}
+			i := addr - seg.base
+			need := uint32(1)
+			switch typ & 0xE0 {
+			case o65RelocWord:
+				need = 2
+			case o65RelocSegAdr:
+				need = 3
+			}
+			if i+need > uint32(len(seg.mem)) || i+need < i {
+				return nil, fmt.Errorf("o65 relocation outside segment at $%X", addr)
+			}
+			m := seg.mem[i:]
+			switch typ & 0xE0 {
+			case o65RelocLow:
+				m[0] += byte(d)
+			case o65RelocHigh:
+				lo := uint32(0)
+				if mode&o65ModePage == 0 {
+					lo = uint32(r.byte())
+				}
+				m[0] = byte((uint32(m[0])<<8 | lo + d) >> 8)
+			case o65RelocWord:
+				binary.LittleEndian.PutUint16(m, binary.LittleEndian.Uint16(m)+uint16(d))
+			case o65RelocSeg:
+				lo := r.word()
+				m[0] = byte((uint32(m[0])<<16 | lo + d) >> 16)
+			case o65RelocSegAdr:
+				v := uint32(m[0]) | uint32(m[1])<<8 | uint32(m[2])<<16
+				v += d
+				m[0], m[1], m[2] = byte(v), byte(v>>8), byte(v>>16)
+			default:
+				return nil, fmt.Errorf("o65 relocation type $%02X not supported", typ&0xE0)
+			}
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	var segs []memSegment
+	segs = addSegment(segs, newT, text)
+	segs = addSegment(segs, newD, dat)
+	return sortSegments(segs)
+}
+
+// Load a raw binary at base
+func loadBinary(data []byte, base uint32, haveBase bool) ([]memSegment, error) {
+	return []memSegment{{Address: base, Data: data}}, nil
+}
+
+// Add data at addr to a segment list, extending the last segment if the new
+// data follows on from it
+func addSegment(segs []memSegment, addr uint32, data []byte) []memSegment {
+	if len(data) == 0 {
+		return segs
+	}
+	if n := len(segs); n > 0 {
+		last := &segs[n-1]
+		if last.Address+uint32(len(last.Data)) == addr {
+			last.Data = append(last.Data, data...)
+			return segs
+		}
+	}
+	return append(segs, memSegment{Address: addr, Data: append([]byte(nil), data...)})
+}
+
+// Sort segments by address, merging adjacent ones and refusing overlaps
+func sortSegments(segs []memSegment) ([]memSegment, error) {
+	sort.SliceStable(segs, func(i, j int) bool {
+		return segs[i].Address < segs[j].Address
+	})
+	var out []memSegment
+	for _, s := range segs {
+		if n := len(out); n > 0 {
+			end := out[n-1].Address + uint32(len(out[n-1].Data))
+			if s.Address < end {
+				return nil, fmt.Errorf("data overlaps at $%06X", s.Address)
+			}
+		}
+		out = addSegment(out, s.Address, s.Data)
+	}
+	return out, nil
+}
+
+// Load a memory image file of any supported format.  base is the load
+// address, if haveBase is false a format that needs one is an error.
+func loadImageFile(name string, base uint32, haveBase bool) ([]memSegment, *imageFormat, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	f := detectImageFormat(name, data)
+	if f.needBase && !haveBase {
+		return nil, f, fmt.Errorf("a load address is needed for %s files", f.name)
+	}
+	segs, err := f.load(data, base, haveBase)
+	return segs, f, err
+}
+
+// Save memory read from addr to a file, choosing the format by the file's
+// extension: Intel hex for .hex, .ihx and .ihex, a hex dump for .txt and
+// .dump, otherwise raw binary.
+func saveMemoryFile(name string, addr uint32, data []byte) error {
+	file, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".hex", ".ihx", ".ihex":
+		mem := gohex.NewMemory()
+		if err = mem.AddBinary(addr, data); err == nil {
+			err = mem.DumpIntelHex(w, 16)
+		}
+	case ".txt", ".dump":
+		_, err = w.WriteString(formatHexDump(addr, data))
+	default:
+		_, err = w.Write(data)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
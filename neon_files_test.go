@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Make an S-record of the given type with an address of alen bytes
+func srec(typ byte, alen int, addr uint32, data []byte) string {
+	rec := []byte{byte(alen + len(data) + 1)}
+	for i := alen - 1; i >= 0; i-- {
+		rec = append(rec, byte(addr>>(8*uint(i))))
+	}
+	rec = append(rec, data...)
+	sum := byte(0)
+	for _, b := range rec {
+		sum += b
+	}
+	return fmt.Sprintf("S%c%X%02X\n", typ, rec, ^sum)
+}
+
+func TestLoadSRecord(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		want []memSegment
+		err  string
+	}{
+		{
+			name: "S1 records merged",
+			file: srec('0', 2, 0, []byte("hdr")) + srec('1', 2, 0x1000, []byte{1, 2}) +
+				srec('1', 2, 0x1002, []byte{3}) + srec('9', 2, 0x1000, nil),
+			want: []memSegment{{0x1000, []byte{1, 2, 3}}},
+		},
+		{
+			name: "S2 and S3 sorted",
+			file: srec('3', 4, 0x20_0000, []byte{9}) + srec('2', 3, 0x80_0000, []byte{8}),
+			want: []memSegment{{0x20_0000, []byte{9}}, {0x80_0000, []byte{8}}},
+		},
+		{
+			name: "Wikipedia example",
+			file: "S1137AF00A0A0D0000000000000000000000000061\r\n",
+			want: []memSegment{{0x7AF0, []byte{0x0A, 0x0A, 0x0D, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}}},
+		},
+		{
+			name: "bad checksum",
+			file: "S1137AF00A0A0D0000000000000000000000000062\n",
+			err:  "line 1: bad checksum",
+		},
+		{
+			name: "bad length",
+			file: srec('1', 2, 0, []byte{1}) + "S10600000102F7\n",
+			err:  "line 2: malformed record",
+		},
+		{
+			name: "overlap",
+			file: srec('1', 2, 0x1000, []byte{1, 2}) + srec('1', 2, 0x1001, []byte{3}),
+			err:  "data overlaps at $001001",
+		},
+	}
+	for _, tt := range tests {
+		got, err := loadSRecord([]byte(tt.file), 0, false)
+		switch {
+		case tt.err != "":
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: error %v, want %s", tt.name, err, tt.err)
+			}
+		case err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case !reflect.DeepEqual(got, tt.want):
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// An o65 file with text at $1000 holding LDA $1003 and LDA #>$1003
+var testO65 = []byte{
+	0x01, 0x00, 'o', '6', '5', 0x00, // magic
+	0x00, 0x00, // mode
+	0x00, 0x10, 0x05, 0x00, // text base and length
+	0x00, 0x20, 0x01, 0x00, // data base and length
+	0x00, 0x30, 0x00, 0x00, // bss
+	0x00, 0x00, 0x00, 0x00, // zero page
+	0x00, 0x00, // stack
+	0x00,                         // no header options
+	0xAD, 0x03, 0x10, 0xA9, 0x10, // text
+	0x42,       // data
+	0x00, 0x00, // no undefined references
+	0x02, 0x82, // word at $1001, text
+	0x03, 0x42, 0x03, // high byte at $1004, text, low byte $03
+	0x00, // end of text relocations
+	0x00, // end of data relocations
+}
+
+func TestLoadO65(t *testing.T) {
+	tests := []struct {
+		base     uint32
+		haveBase bool
+		want     []memSegment
+	}{
+		{0, false, []memSegment{{0x1000, []byte{0xAD, 0x03, 0x10, 0xA9, 0x10}}, {0x2000, []byte{0x42}}}},
+		{0x4000, true, []memSegment{{0x4000, []byte{0xAD, 0x03, 0x40, 0xA9, 0x40, 0x42}}}},
+		{0, true, []memSegment{{0x0000, []byte{0xAD, 0x03, 0x00, 0xA9, 0x00, 0x42}}}},
+	}
+	for _, tt := range tests {
+		got, err := loadO65(testO65, tt.base, tt.haveBase)
+		if err != nil {
+			t.Errorf("base $%X: %v", tt.base, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("base $%X (%v): got % X, want % X", tt.base, tt.haveBase, got, tt.want)
+		}
+	}
+	if _, err := loadO65(testO65[:30], 0, false); err == nil {
+		t.Error("truncated file loaded")
+	}
+}
+
+func TestImageFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nico")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := []byte("0123456789abcdef0123456789ABCDEF!")
+	const addr = 0x20_FFF0 // crosses a bank
+	for _, name := range []string{"image.hex", "image.bin"} {
+		path := filepath.Join(dir, name)
+		if err := saveMemoryFile(path, addr, data); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := loadImageFile(path, 0, false); strings.HasSuffix(name, ".bin") && err == nil {
+			t.Errorf("%s loaded without a load address", name)
+		}
+		segs, f, err := loadImageFile(path, addr, true)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(segs) != 1 || segs[0].Address != addr || !bytes.Equal(segs[0].Data, data) {
+			t.Errorf("%s loaded as %s: %v", name, f.name, segs)
+		}
+	}
+}
+
+func TestDetectImageFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"a.HEX", "", "Intel hex"},
+		{"a.s19", "", "S-record"},
+		{"a.o65", "", "o65"},
+		{"a.img", ":00000001FF", "binary"},
+		{"a", ":00000001FF", "Intel hex"},
+		{"a", "S00000", "S-record"},
+		{"a", string(testO65), "o65"},
+		{"a", "\x00\x01", "binary"},
+	}
+	for _, tt := range tests {
+		if f := detectImageFormat(tt.name, []byte(tt.data)); f.name != tt.want {
+			t.Errorf("%s %q detected as %s, want %s", tt.name, tt.data, f.name, tt.want)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+// Flash ROM chip database
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A flash ROM part we know how to drive
+type flashChip struct {
+	mfr, dev      byte          // software ID
+	name          string        // part name
+	size          uint32        // total size
+	sectorSize    uint32        // sector erase size, 0 if only chip erase
+	pageSize      uint32        // page write size, 0 if byte programmed
+	cmd1, cmd2    uint          // unlock command addresses
+	chipTimeout   time.Duration // longest chip erase
+	sectorTimeout time.Duration // longest sector erase
+}
+
+// Manufacturer IDs
+var flashMfrs = map[byte]string{
+	0x01: "AMD/Spansion",
+	0x1F: "Atmel",
+	0xBF: "SST",
+	0xDA: "Winbond",
+}
+
+// Supported parts.  All of them accept the software ID commands at
+// 0x5555/0x2AAA, since the parts with 0x555/0x2AA command addresses ignore
+// the higher address lines during commands.  The Am29F010 is given the
+// original part's addresses, which suit the Am29F010B too.
+//
+// The Winbond W29 parts are programmed a page at a time and erase the page
+// as they do so.  Each page must be loaded within the chip's byte load cycle
+// time, which the debug port may not manage at low speeds.
+var flashChips = []*flashChip{
+	{0xBF, 0xB5, "SST39SF010A", 0x2_0000, 0x1000, 0, 0x5555, 0x2AAA, 10 * time.Second, time.Second},
+	{0xBF, 0xB6, "SST39SF020A", 0x4_0000, 0x1000, 0, 0x5555, 0x2AAA, 10 * time.Second, time.Second},
+	{0xBF, 0xB7, "SST39SF040", 0x8_0000, 0x1000, 0, 0x5555, 0x2AAA, 10 * time.Second, time.Second},
+	{0xBF, 0xD5, "SST39xF010", 0x2_0000, 0x1000, 0, 0x5555, 0x2AAA, 10 * time.Second, time.Second},
+	{0xBF, 0xD6, "SST39xF020", 0x4_0000, 0x1000, 0, 0x5555, 0x2AAA, 10 * time.Second, time.Second},
+	{0xBF, 0xD7, "SST39xF040", 0x8_0000, 0x1000, 0, 0x5555, 0x2AAA, 10 * time.Second, time.Second},
+	{0x01, 0x20, "Am29F010", 0x2_0000, 0x4000, 0, 0x5555, 0x2AAA, 60 * time.Second, 30 * time.Second},
+	{0x01, 0xA4, "Am29F040", 0x8_0000, 0x1_0000, 0, 0x555, 0x2AA, 60 * time.Second, 30 * time.Second},
+	{0x1F, 0x17, "AT49F010", 0x2_0000, 0, 0, 0x5555, 0x2AAA, 20 * time.Second, 0},
+	{0x1F, 0x0B, "AT49F020", 0x4_0000, 0, 0, 0x5555, 0x2AAA, 20 * time.Second, 0},
+	{0x1F, 0x13, "AT49F040", 0x8_0000, 0, 0, 0x5555, 0x2AAA, 20 * time.Second, 0},
+	{0xDA, 0xC1, "W29C011", 0x2_0000, 0, 0x80, 0x5555, 0x2AAA, time.Second, 0},
+	{0xDA, 0x45, "W29C020", 0x4_0000, 0, 0x80, 0x5555, 0x2AAA, time.Second, 0},
+	{0xDA, 0x46, "W29C040", 0x8_0000, 0, 0x100, 0x5555, 0x2AAA, time.Second, 0},
+}
+
+// Return the part with the given IDs, or nil if we don't know it
+func findFlashChip(mfr, dev byte) *flashChip {
+	for _, c := range flashChips {
+		if c.mfr == mfr && c.dev == dev {
+			return c
+		}
+	}
+	return nil
+}
+
+// Return the part with the given name, or nil if we don't know it
+func findFlashChipByName(name string) *flashChip {
+	for _, c := range flashChips {
+		if strings.EqualFold(c.name, name) {
+			return c
+		}
+	}
+	return nil
+}
+
+// Return the manufacturer name for an ID
+func flashMfrName(mfr byte) string {
+	if name, ok := flashMfrs[mfr]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%02X", mfr)
+}
+
+// Describe a part for the user
+func (c *flashChip) String() string {
+	s := fmt.Sprintf("%s (%vK", c.name, c.size/1024)
+	switch {
+	case c.sectorSize != 0:
+		s += fmt.Sprintf(", %vK sectors)", c.sectorSize/1024)
+	case c.pageSize != 0:
+		s += fmt.Sprintf(", %v byte pages)", c.pageSize)
+	default:
+		s += ", chip erase only)"
+	}
+	return s
+}
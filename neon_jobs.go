@@ -0,0 +1,234 @@
+package main
+
+// Background jobs
+
+// Commands that can keep the debug port busy for a long time run as a job in
+// their own goroutine, so that the debug goroutine can still answer jobs,
+// abort and the commands that don't need the port.  There is only one debug
+// port, so only one job runs at a time, and breakpoints and watches aren't
+// polled meanwhile.
+//
+// Aborting closes the target's cancel channel, which the long operations
+// check between bytes, so a flash program or erase already under way is
+// always finished first.  Jobs that may have been talking to the flash ROM
+// put it back in read mode if they are aborted or fail.
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How many finished jobs jobs shows
+const jobHistoryMax = 8
+
+// Commands run as jobs
+var jobCommands = map[string]bool{
+	"program":      true,
+	"verify":       true,
+	"flash":        true,
+	"verify-rom":   true,
+	"backup-rom":   true,
+	"dump":         true,
+	"erase":        true,
+	"erase-sector": true,
+	"step":         true,
+	"step-until":   true,
+}
+
+// Commands that leave the flash ROM in command mode if they stop part way
+var jobFlashCommands = map[string]bool{
+	"flash":        true,
+	"erase":        true,
+	"erase-sector": true,
+}
+
+// Commands that can run while a job has the debug port
+var jobFreeCommands = map[string]bool{
+	"calc":    true,
+	"breaks":  true,
+	"mapping": true,
+	"watch":   true,
+	"unwatch": true,
+	"status":  true,
+}
+
+// A command running in the background
+type debugJob struct {
+	num      int
+	words    []string
+	started  time.Time
+	ended    time.Time     // zero while running
+	abort    chan struct{} // closed to abort
+	aborting bool          // abort has been asked for
+	stopped  bool          // the command stopped because it was aborted
+	failed   bool          // the command got a debug port error
+
+	mu       sync.Mutex
+	progress string // how far it has got, for jobs
+}
+
+// Job state, for the debug goroutine.  The running job also reads job to
+// record its progress.
+var (
+	job        *debugJob   // running job, nil if none
+	jobHistory []*debugJob // finished jobs, oldest first
+	jobNext    = 1         // number of the next job
+	jobDone    = make(chan *debugJob, 1)
+)
+
+// Run a command from the command line, as a job if it takes a while
+func debugCommand(t *neonTarget, words []string) {
+	name := strings.ToLower(words[0])
+	switch {
+	case asmActive:
+		doDebugCommand(t, words)
+	case name == "jobs":
+		debugJobs()
+	case name == "abort":
+		jobAbort(false)
+	case job != nil:
+		if !jobFreeCommands[name] {
+			debugOutputChan <- fmt.Sprintf("Busy with job %v (%s), wait or abort it!\n", job.num, job.command())
+			return
+		}
+		doDebugCommand(t, words)
+	case jobCommands[name]:
+		jobStart(t, words)
+	default:
+		watchPause()
+		t.retried = 0
+		doDebugCommand(t, words)
+		debugRetried(t)
+		debugPollWatches(t)
+	}
+}
+
+// Start a job, giving it the debug port until it's done
+func jobStart(t *neonTarget, words []string) {
+	j := &debugJob{
+		num:     jobNext,
+		words:   words,
+		started: time.Now(),
+		abort:   make(chan struct{}),
+	}
+	jobNext++
+	job = j
+	t.cancel = j.abort
+	t.retried = 0
+	watchPause()
+	debugOutputChan <- fmt.Sprintf("Job %v started, Esc or abort to stop it\n", j.num)
+	go func() {
+		doDebugCommand(t, j.words)
+		debugRetried(t)
+		if (j.stopped || j.failed) && jobFlashCommands[strings.ToLower(j.words[0])] {
+			if debugReportError(t.ResetFlash(flashBank)) {
+				debugOutputChan <- "Flash ROM back in read mode\n"
+			}
+		}
+		jobDone <- j
+	}()
+}
+
+// Clean up after a job, once it has sent itself to jobDone
+func jobFinish(t *neonTarget, j *debugJob) {
+	t.cancel = nil
+	j.ended = time.Now()
+	job = nil
+	jobHistory = append(jobHistory, j)
+	if len(jobHistory) > jobHistoryMax {
+		jobHistory = jobHistory[1:]
+	}
+	what := "finished"
+	switch {
+	case j.stopped:
+		what = "aborted"
+	case j.failed:
+		what = "failed"
+	}
+	debugOutputChan <- fmt.Sprintf("Job %v (%s) %s after %v\n", j.num, j.command(), what, j.ended.Sub(j.started).Round(time.Second))
+	debugPollWatches(t)
+}
+
+// Abort the running job.  Quietly does nothing if there isn't one and quiet
+// is set, as for Esc.
+func jobAbort(quiet bool) {
+	switch {
+	case job == nil:
+		if !quiet {
+			debugOutputChan <- "No job running!\n"
+		}
+	case job.aborting:
+		debugOutputChan <- fmt.Sprintf("Job %v is already stopping\n", job.num)
+	default:
+		job.aborting = true
+		close(job.abort)
+		debugOutputChan <- fmt.Sprintf("Aborting job %v...\n", job.num)
+	}
+}
+
+// List the running job and the ones that have finished
+func debugJobs() {
+	if job == nil && len(jobHistory) == 0 {
+		debugOutputChan <- "No jobs\n"
+		return
+	}
+	for _, j := range jobHistory {
+		what := "done"
+		switch {
+		case j.stopped:
+			what = "aborted"
+		case j.failed:
+			what = "failed"
+		}
+		debugOutputChan <- fmt.Sprintf("%3v  %-8s %6v  %s\n", j.num, what, j.ended.Sub(j.started).Round(time.Second), j.command())
+	}
+	if j := job; j != nil {
+		what := "running"
+		if j.aborting {
+			what = "stopping"
+		}
+		j.mu.Lock()
+		progress := j.progress
+		j.mu.Unlock()
+		if progress != "" {
+			progress = ", " + progress
+		}
+		debugOutputChan <- fmt.Sprintf("%3v  %-8s %6v  %s%s\n", j.num, what, time.Since(j.started).Round(time.Second), j.command(), progress)
+	}
+}
+
+// Return the command line of a job
+func (j *debugJob) command() string {
+	return strings.Join(nonEmpty(j.words), " ")
+}
+
+// Note that the running job, if there is one, stopped because it was aborted
+func jobStopped() {
+	if j := job; j != nil {
+		j.stopped = true
+	}
+}
+
+// Note that the running job, if there is one, got a debug port error
+func jobFailed() {
+	if j := job; j != nil {
+		j.failed = true
+	}
+}
+
+// Record what the running job is doing, if there is one
+func jobStatus(format string, args ...interface{}) {
+	if j := job; j != nil {
+		j.mu.Lock()
+		j.progress = fmt.Sprintf(format, args...)
+		j.mu.Unlock()
+	}
+}
+
+// Show how far a long operation has got
+func debugProgress(done, total int) {
+	jobStatus("%v%%", done*100/total)
+	debugOutputChan <- fmt.Sprintf("%v%%\r", done*100/total)
+}
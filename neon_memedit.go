@@ -0,0 +1,461 @@
+package main
+
+// Interactive memory editor
+
+// memedit takes over the debug pane with a grid of memory in hex and ASCII.
+// The editor lives in the debug goroutine, which owns the port: the UI sends
+// it keys along with the size of the pane, and it sends back what to draw.
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"github.com/mgcaret/goncurses"
+	"sort"
+	"strings"
+)
+
+const (
+	memeditWidth       = 16      // bytes per row
+	memeditSearchChunk = 0x400   // bytes read at a time when searching
+	memeditSearchLimit = 0x10000 // how far a search looks
+)
+
+// A key for the memory editor, and the rows of the pane it was pressed in.
+// Alt+key is sent as -key, and key 0 just redraws.
+type memeditInput struct {
+	key  goncurses.Key
+	rows int
+}
+
+// What the memory editor pane shows, sent to the UI
+type memeditScreen struct {
+	rows       int          // pane rows this was drawn for
+	lines      [][]paneSpan // grid rows, then the status line
+	curY, curX int          // where the cursor goes
+	done       bool         // close the pane
+}
+
+// Memory editor state
+type memEditor struct {
+	rows    int             // grid rows
+	top     uint32          // address of the first row
+	cursor  uint32          // address of the byte under the cursor
+	nibble  bool            // the high digit of the cursor byte has been typed
+	ascii   bool            // typing in the ASCII column
+	commit  bool            // edits wait for ^W rather than being written as typed
+	pending map[uint32]byte // edits not yet written
+	data    []byte          // memory from top, short if a read failed
+	prompt  string          // "Goto" or "Search" while a line is typed
+	input   string          // line typed so far
+	search  []byte          // what was last searched for
+	status  string          // message for the status line
+	leaving bool            // Esc was pressed with edits pending
+}
+
+// The memory editor, nil when not editing
+var memedit *memEditor
+
+// Start the memory editor
+func debugMemedit(args []string) {
+	opts, args, ok := splitOptions(args, "commit")
+	if !ok {
+		return
+	}
+	if len(args) < 1 {
+		debugOutputChan <- "Usage: memedit [--commit] <addr>\n"
+		return
+	}
+	addr, err := parseAddr(args[0])
+	if err != nil {
+		debugOutputChan <- fmt.Sprintf("Bad address: %s\n", args[0])
+		return
+	}
+	_, commit := opts["commit"]
+	memedit = &memEditor{cursor: addr, commit: commit, pending: make(map[uint32]byte)}
+	memedit.top = memedit.rowOf(addr)
+	// the UI opens the pane and asks for it to be filled
+	memeditOutputChan <- &memeditScreen{}
+}
+
+// Handle a key for the memory editor
+func memeditKey(t *neonTarget, in memeditInput) {
+	m := memedit
+	if m == nil {
+		return
+	}
+	if in.rows-1 != m.rows && in.rows > 1 {
+		m.rows = in.rows - 1
+		m.show(m.cursor)
+		m.read(t)
+	}
+	if in.key != 0 {
+		m.status = ""
+		if m.prompt != "" {
+			m.promptKey(t, in.key)
+		} else {
+			m.key(t, in.key)
+		}
+	}
+	if memedit == nil {
+		memeditOutputChan <- &memeditScreen{done: true}
+		return
+	}
+	memeditOutputChan <- m.screen()
+}
+
+// Handle a key while editing
+func (m *memEditor) key(t *neonTarget, k goncurses.Key) {
+	if k != 0x1B {
+		m.leaving = false
+	}
+	page := m.rows * memeditWidth
+	switch {
+	case k == 0x1B: // Esc
+		if len(m.pending) > 0 && !m.leaving {
+			m.status = fmt.Sprintf("%v byte%s not written, ^W to write or Esc to discard",
+				len(m.pending), plural(len(m.pending)))
+			m.leaving = true
+			return
+		}
+		memedit = nil
+	case k == goncurses.KEY_LEFT:
+		m.move(t, -1)
+	case k == goncurses.KEY_RIGHT:
+		m.move(t, 1)
+	case k == goncurses.KEY_UP:
+		m.move(t, -memeditWidth)
+	case k == goncurses.KEY_DOWN:
+		m.move(t, memeditWidth)
+	case k == goncurses.KEY_HOME, k == 1:
+		m.move(t, -int(m.cursor%memeditWidth))
+	case k == goncurses.KEY_END, k == 5:
+		m.move(t, memeditWidth-1-int(m.cursor%memeditWidth))
+	case k == goncurses.KEY_PAGEUP:
+		m.page(t, -page)
+	case k == goncurses.KEY_PAGEDOWN:
+		m.page(t, page)
+	case k == 9: // Tab
+		m.ascii = !m.ascii
+		m.nibble = false
+	case k == 7: // ^G
+		m.prompt, m.input = "Goto", ""
+	case k == 6: // ^F
+		m.prompt, m.input = "Search", ""
+	case k == 14: // ^N
+		m.find(t)
+	case k == 18: // ^R
+		m.read(t)
+	case k == 23: // ^W
+		m.write(t)
+	case m.ascii && k >= 0x20 && k <= 0x7E:
+		m.set(t, byte(k))
+		m.move(t, 1)
+	case !m.ascii && strings.ContainsRune("0123456789ABCDEFabcdef", rune(k)):
+		d, _ := hex.DecodeString("0" + string(rune(k)))
+		v, _ := m.at(m.cursor)
+		if !m.nibble {
+			m.set(t, d[0]<<4|v&0x0F)
+			m.nibble = true
+		} else {
+			m.set(t, v&0xF0|d[0])
+			m.move(t, 1)
+		}
+	}
+}
+
+// Handle a key while a goto address or search is typed
+func (m *memEditor) promptKey(t *neonTarget, k goncurses.Key) {
+	switch k {
+	case 0x1B:
+		m.prompt = ""
+	case 13, 10, goncurses.KEY_ENTER:
+		prompt, input := m.prompt, strings.TrimSpace(m.input)
+		m.prompt = ""
+		if input == "" {
+			return
+		}
+		if prompt == "Goto" {
+			m.goTo(t, input)
+		} else if m.setSearch(input) {
+			m.find(t)
+		}
+	case 127, 8, goncurses.KEY_BACKSPACE:
+		if m.input != "" {
+			m.input = m.input[:len(m.input)-1]
+		}
+	default:
+		if k >= 0x20 && k <= 0x7E {
+			m.input += string(rune(k))
+		}
+	}
+}
+
+// Return the address of the row holding addr
+func (m *memEditor) rowOf(addr uint32) uint32 {
+	return addr - addr%memeditWidth
+}
+
+// Return the highest address the grid can start at
+func (m *memEditor) maxTop() uint32 {
+	return uint32(0x100_0000 - m.rows*memeditWidth)
+}
+
+// Scroll so that addr is shown, returning true if the grid moved
+func (m *memEditor) show(addr uint32) bool {
+	top := m.top
+	last := m.top + uint32((m.rows-1)*memeditWidth)
+	switch {
+	case addr < m.top:
+		top = m.rowOf(addr)
+	case addr > last+memeditWidth-1:
+		top = m.rowOf(addr) - uint32((m.rows-1)*memeditWidth)
+	}
+	if top > m.maxTop() {
+		top = m.maxTop()
+	}
+	moved := top != m.top
+	m.top = top
+	return moved
+}
+
+// Move the cursor, if it stays in memory
+func (m *memEditor) move(t *neonTarget, n int) {
+	a := int64(m.cursor) + int64(n)
+	if a < 0 || a > 0xFF_FFFF {
+		return
+	}
+	m.cursor, m.nibble = uint32(a), false
+	if m.show(m.cursor) {
+		m.read(t)
+	}
+}
+
+// Move the grid and the cursor by n bytes, crossing banks as needed
+func (m *memEditor) page(t *neonTarget, n int) {
+	top := int64(m.top) + int64(n)
+	if top < 0 {
+		top = 0
+	}
+	if max := int64(m.maxTop()); top > max {
+		top = max
+	}
+	d := top - int64(m.top)
+	m.top, m.cursor, m.nibble = uint32(top), uint32(int64(m.cursor)+d), false
+	m.read(t)
+}
+
+// Read the memory shown
+func (m *memEditor) read(t *neonTarget) {
+	data, err := t.ReadMemory(m.top, m.rows*memeditWidth)
+	m.data = data
+	if err != nil {
+		m.status = fmt.Sprintf("Read error: %v", err)
+	}
+}
+
+// Return the byte at addr, as edited, if it is shown
+func (m *memEditor) at(addr uint32) (byte, bool) {
+	if v, ok := m.pending[addr]; ok {
+		return v, true
+	}
+	i := int(addr - m.top)
+	if addr < m.top || i >= len(m.data) {
+		return 0, false
+	}
+	return m.data[i], true
+}
+
+// Change the byte under the cursor
+func (m *memEditor) set(t *neonTarget, v byte) {
+	if m.commit {
+		m.pending[m.cursor] = v
+		return
+	}
+	if err := t.WriteMemory(m.cursor, []byte{v}); err != nil {
+		m.status = fmt.Sprintf("Write error: %v", err)
+		return
+	}
+	b, err := t.ReadMemory(m.cursor, 1)
+	if err != nil {
+		m.status = fmt.Sprintf("Read error: %v", err)
+		return
+	}
+	if i := int(m.cursor - m.top); i < len(m.data) {
+		m.data[i] = b[0]
+	}
+	if b[0] != v {
+		m.status = fmt.Sprintf("$%06X is still $%02X, is it RAM?", m.cursor, b[0])
+	}
+}
+
+// Write the pending edits, a run of bytes at a time
+func (m *memEditor) write(t *neonTarget) {
+	if len(m.pending) == 0 {
+		m.status = "Nothing to write"
+		return
+	}
+	var addrs []uint32
+	for a := range m.pending {
+		addrs = append(addrs, a)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+	for i := 0; i < len(addrs); {
+		run := []byte{m.pending[addrs[i]]}
+		j := i + 1
+		for ; j < len(addrs) && addrs[j] == addrs[j-1]+1; j++ {
+			run = append(run, m.pending[addrs[j]])
+		}
+		if err := t.WriteMemory(addrs[i], run); err != nil {
+			m.status = fmt.Sprintf("Write error: %v", err)
+			return
+		}
+		for _, a := range addrs[i:j] {
+			delete(m.pending, a)
+		}
+		i = j
+	}
+	m.read(t)
+	m.status = fmt.Sprintf("Wrote %v byte%s", len(addrs), plural(len(addrs)))
+}
+
+// Move to the address typed
+func (m *memEditor) goTo(t *neonTarget, s string) {
+	addr, err := parseAddr(s)
+	if err != nil {
+		m.status = fmt.Sprintf("Bad address: %s", s)
+		return
+	}
+	m.cursor, m.nibble = addr, false
+	m.top = m.rowOf(addr)
+	if m.top > m.maxTop() {
+		m.top = m.maxTop()
+	}
+	m.read(t)
+}
+
+// Set what to search for, "text" or hex bytes, returning false if it's no good
+func (m *memEditor) setSearch(s string) bool {
+	if len(s) > 1 && s[0] == '"' {
+		m.search = []byte(strings.TrimSuffix(s[1:], "\""))
+		return true
+	}
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil || len(b) == 0 {
+		m.status = fmt.Sprintf("Search for hex bytes or \"text\", not %s", s)
+		return false
+	}
+	m.search = b
+	return true
+}
+
+// Find the next match for the search after the cursor
+func (m *memEditor) find(t *neonTarget) {
+	if len(m.search) == 0 {
+		m.status = "Nothing to search for, use ^F"
+		return
+	}
+	start := m.cursor + 1
+	var buf []byte
+	for off := 0; off < memeditSearchLimit && int64(start)+int64(off) <= 0xFF_FFFF; off += memeditSearchChunk {
+		addr := start + uint32(off)
+		m.status = fmt.Sprintf("Searching $%06X...", addr)
+		select {
+		case memeditOutputChan <- m.screen():
+		default:
+			// the UI hasn't drawn the last one yet, so skip this one
+		}
+		n := memeditSearchChunk
+		if rest := 0x100_0000 - int(addr); rest < n {
+			n = rest
+		}
+		data, err := t.ReadMemory(addr, n)
+		if err != nil {
+			m.status = fmt.Sprintf("Read error: %v", err)
+			return
+		}
+		// keep enough of the last chunk for a match across the boundary
+		base := int64(addr) - int64(len(buf))
+		buf = append(buf, data...)
+		if i := bytes.Index(buf, m.search); i >= 0 {
+			m.cursor, m.nibble = uint32(base+int64(i)), false
+			m.show(m.cursor)
+			m.read(t)
+			m.status = fmt.Sprintf("Found at %s", describeAddr(m.cursor))
+			return
+		}
+		if keep := len(m.search) - 1; len(buf) > keep {
+			buf = buf[len(buf)-keep:]
+		}
+	}
+	m.status = fmt.Sprintf("Not found within $%X bytes of $%06X", memeditSearchLimit, start)
+}
+
+// Return what the pane should show
+func (m *memEditor) screen() *memeditScreen {
+	s := &memeditScreen{rows: m.rows + 1}
+	width := func(line []paneSpan) int {
+		n := 0
+		for _, span := range line {
+			n += len(span.text)
+		}
+		return n
+	}
+	for r := 0; r < m.rows; r++ {
+		row := m.top + uint32(r*memeditWidth)
+		line := []paneSpan{{fmt.Sprintf("%06X ", row), false}}
+		var chars []paneSpan
+		cursorChar := -1
+		for i := uint32(0); i < memeditWidth; i++ {
+			a := row + i
+			line = append(line, paneSpan{" ", false})
+			if i == memeditWidth/2 {
+				line = append(line, paneSpan{" ", false})
+			}
+			v, ok := m.at(a)
+			_, edited := m.pending[a]
+			cell, char := "??", " "
+			if ok {
+				cell, char = fmt.Sprintf("%02X", v), "."
+				if v >= 0x20 && v <= 0x7E {
+					char = string(v)
+				}
+			}
+			if a == m.cursor {
+				s.curY, s.curX, cursorChar = r, width(line), int(i)
+				if m.nibble {
+					s.curX++
+				}
+			}
+			// edits waiting to be written, and the cursor byte in the other
+			// column, are highlighted
+			line = append(line, paneSpan{cell, edited || (a == m.cursor && m.ascii)})
+			chars = append(chars, paneSpan{char, edited || (a == m.cursor && !m.ascii)})
+		}
+		line = append(line, paneSpan{"  ", false})
+		if cursorChar >= 0 && m.ascii {
+			s.curX = width(line) + cursorChar
+		}
+		s.lines = append(s.lines, append(line, chars...))
+	}
+	var status string
+	switch {
+	case m.prompt != "":
+		status = m.prompt + ": " + m.input
+		s.curY, s.curX = m.rows, len(status)
+	case m.status != "":
+		status = m.status
+	default:
+		mode := "hex"
+		if m.ascii {
+			mode = "ASCII"
+		}
+		status = fmt.Sprintf("%s %s  Tab=hex/ASCII ^G=goto ^F=find ^N=next ^R=reread", describeAddr(m.cursor), mode)
+		if m.commit {
+			status += fmt.Sprintf(" ^W=write(%v)", len(m.pending))
+		}
+		status += " Esc=exit"
+	}
+	s.lines = append(s.lines, []paneSpan{{status, false}})
+	return s
+}
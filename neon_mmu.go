@@ -0,0 +1,239 @@
+package main
+
+// Bank 0 memory mapping
+
+// Bank 0 is mapped through the MMU in 16 slots of 4K.  Each slot has two
+// registers in bank $08, the middle and high bytes of the address the slot
+// maps to.  We remember what we last wrote to them for the mapping command.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+const (
+	mmuRegisters = 0x08_0000 // registers of slot 0
+	mmuSlots     = 16
+	mmuSlotSize  = 0x1000
+)
+
+// What each slot maps to, or -1 to leave it alone (or for not known)
+type mmuLayout [mmuSlots]int64
+
+// Layouts by name, the built-in ones and any loaded from files
+var mmuPresets = map[string]mmuLayout{
+	"ram": mmuBankLayout(0x80),
+	"rom": mmuBankLayout(flashBank),
+}
+
+// What we last wrote to the MMU
+var mmuMapping = mmuEmptyLayout()
+
+// Return a layout that leaves every slot alone
+func mmuEmptyLayout() mmuLayout {
+	var l mmuLayout
+	for i := range l {
+		l[i] = -1
+	}
+	return l
+}
+
+// Return a layout mapping bank 0 to the same addresses in another bank
+func mmuBankLayout(bank uint32) mmuLayout {
+	var l mmuLayout
+	for i := range l {
+		l[i] = int64(bank<<16 | uint32(i)*mmuSlotSize)
+	}
+	return l
+}
+
+// Set slots first to last of a layout from a bank, which keeps each slot's
+// place in the bank, or a 4K aligned address for the first slot with the
+// rest following on
+func (l *mmuLayout) set(first, last int, v int64) error {
+	for i := first; i <= last; i++ {
+		a := v<<16 | int64(i)*mmuSlotSize
+		if v > 0xFF {
+			a = v + int64(i-first)*mmuSlotSize
+		}
+		switch {
+		case v < 0 || a > 0xFF_FFFF:
+			return fmt.Errorf("$%X is out of range", v)
+		case a%mmuSlotSize != 0:
+			return fmt.Errorf("$%06X is not on a 4K boundary", v)
+		}
+		l[i] = a
+	}
+	return nil
+}
+
+// Parse a slot number or range of them, such as 3 or 0-7
+func parseSlots(s string) (int, int, error) {
+	r := strings.SplitN(s, "-", 2)
+	first, err := evalExpr(r[0])
+	last := first
+	if err == nil && len(r) > 1 {
+		last, err = evalExpr(r[1])
+	}
+	if err != nil || first < 0 || last >= mmuSlots || first > last {
+		return 0, 0, fmt.Errorf("bad slot %s, slots are 0-%v", s, mmuSlots-1)
+	}
+	return int(first), int(last), nil
+}
+
+// Write the slots a layout sets to the MMU
+func mmuWrite(t *neonTarget, l mmuLayout) bool {
+	for i := 0; i < mmuSlots; {
+		if l[i] < 0 {
+			i++
+			continue
+		}
+		// one write for each run of slots being set
+		var regs []byte
+		j := i
+		for ; j < mmuSlots && l[j] >= 0; j++ {
+			regs = append(regs, byte(l[j]>>8), byte(l[j]>>16))
+		}
+		if !debugReportError(t.WriteMemory(mmuRegisters+uint32(2*i), regs)) {
+			return false
+		}
+		for ; i < j; i++ {
+			mmuMapping[i] = l[i]
+		}
+	}
+	return true
+}
+
+// Map slots of bank 0
+func debugMap(t *neonTarget, args []string) {
+	args = nonEmpty(args)
+	if len(args) != 2 {
+		debugOutputChan <- "Usage: map <slot>[-<slot>] <bank>|<addr>\n"
+		return
+	}
+	first, last, err := parseSlots(args[0])
+	if err != nil {
+		debugOutputChan <- fmt.Sprintf("Bad mapping: %v!\n", err)
+		return
+	}
+	v, err := evalExpr(args[1])
+	if err != nil {
+		debugOutputChan <- fmt.Sprintf("Bad bank or address: %s\n", args[1])
+		return
+	}
+	l := mmuEmptyLayout()
+	if err := l.set(first, last, v); err != nil {
+		debugOutputChan <- fmt.Sprintf("Bad mapping: %v!\n", err)
+		return
+	}
+	if mmuWrite(t, l) {
+		for i := first; i <= last; i++ {
+			debugOutputChan <- formatMapping(i)
+		}
+	}
+}
+
+// Apply a preset layout, or load presets from a file, or list them
+func debugMapPreset(t *neonTarget, args []string) {
+	opts, args, ok := splitOptions(args, "load")
+	if !ok {
+		return
+	}
+	if file, ok := opts["load"]; ok {
+		n, err := loadMMUPresets(file)
+		if err != nil {
+			debugOutputChan <- fmt.Sprintf("Error loading %s: %v\n", file, err)
+			return
+		}
+		debugOutputChan <- fmt.Sprintf("Loaded %v preset%s from %s\n", n, plural(n), file)
+	}
+	if len(args) == 0 {
+		var names []string
+		for name := range mmuPresets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		debugOutputChan <- fmt.Sprintf("Presets: %s\n", strings.Join(names, " "))
+		return
+	}
+	l, ok := mmuPresets[strings.ToLower(args[0])]
+	if !ok {
+		debugOutputChan <- fmt.Sprintf("No preset %s!\n", args[0])
+		return
+	}
+	// stop and reset first, since bank 0 may change under the CPU
+	t.send("]R")
+	if mmuWrite(t, l) {
+		debugOutputChan <- fmt.Sprintf("Mapped bank 0 with preset %s!\n", strings.ToLower(args[0]))
+	}
+}
+
+// Show what we last wrote to the MMU
+func debugMapping() {
+	for i := 0; i < mmuSlots; i++ {
+		debugOutputChan <- formatMapping(i)
+	}
+}
+
+// Describe the mapping of a slot
+func formatMapping(slot int) string {
+	s := fmt.Sprintf("%2v  $00:%04X-$00:%04X", slot, slot*mmuSlotSize, (slot+1)*mmuSlotSize-1)
+	if mmuMapping[slot] < 0 {
+		return s + "  (not set by nico)\n"
+	}
+	a := mmuMapping[slot]
+	return s + fmt.Sprintf(" -> $%02X:%04X-$%02X:%04X\n", a>>16, a&0xFFFF, a>>16, (a&0xFFFF)+mmuSlotSize-1)
+}
+
+// Load presets from a file, returning how many there were.  Each line is a
+// name and the slots it sets as map takes them, such as
+// "ofw 0-7=$80 8-11=$80:8000 15=$20", and # starts a comment.  Slots not
+// given are left alone, and the built-in presets can't be replaced.
+func loadMMUPresets(name string) (int, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return 0, err
+	}
+	presets := make(map[string]mmuLayout)
+	for n, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		if len(f) == 1 {
+			return 0, fmt.Errorf("line %v: preset %s sets no slots", n+1, f[0])
+		}
+		switch strings.ToLower(f[0]) {
+		case "ram", "rom":
+			return 0, fmt.Errorf("line %v: %s is a built-in preset", n+1, f[0])
+		}
+		l := mmuEmptyLayout()
+		for _, s := range f[1:] {
+			kv := strings.SplitN(s, "=", 2)
+			if len(kv) != 2 {
+				return 0, fmt.Errorf("line %v: expected slot=bank, not %s", n+1, s)
+			}
+			first, last, err := parseSlots(kv[0])
+			if err != nil {
+				return 0, fmt.Errorf("line %v: %v", n+1, err)
+			}
+			v, err := evalExpr(kv[1])
+			if err != nil {
+				return 0, fmt.Errorf("line %v: bad bank or address %s", n+1, kv[1])
+			}
+			if err := l.set(first, last, v); err != nil {
+				return 0, fmt.Errorf("line %v: %v", n+1, err)
+			}
+		}
+		presets[strings.ToLower(f[0])] = l
+	}
+	for name, l := range presets {
+		mmuPresets[name] = l
+	}
+	return len(presets), nil
+}
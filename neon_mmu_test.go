@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMMULayoutSet(t *testing.T) {
+	tests := []struct {
+		first, last int
+		v           int64
+		want        map[int]int64 // slots set
+		err         string
+	}{
+		{0, 15, 0x80, map[int]int64{0: 0x80_0000, 1: 0x80_1000, 15: 0x80_F000}, ""},
+		{3, 3, 0x20, map[int]int64{3: 0x20_3000}, ""},
+		{8, 11, 0x81_8000, map[int]int64{8: 0x81_8000, 9: 0x81_9000, 11: 0x81_B000}, ""},
+		{0, 1, 0x1000, map[int]int64{0: 0x1000, 1: 0x2000}, ""},
+		{14, 15, 0xFF_F000, nil, "$FFF000 is out of range"},
+		{0, 0, 0x80_8001, nil, "$808001 is not on a 4K boundary"},
+	}
+	for _, tt := range tests {
+		l := mmuEmptyLayout()
+		err := l.set(tt.first, tt.last, tt.v)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%v-%v $%X: error %v, want %s", tt.first, tt.last, tt.v, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v-%v $%X: %v", tt.first, tt.last, tt.v, err)
+			continue
+		}
+		for i, a := range l {
+			want, ok := tt.want[i]
+			switch {
+			case ok && a != want:
+				t.Errorf("%v-%v $%X: slot %v is $%X, want $%X", tt.first, tt.last, tt.v, i, a, want)
+			case !ok && (i < tt.first || i > tt.last) && a != -1:
+				t.Errorf("%v-%v $%X: slot %v set to $%X", tt.first, tt.last, tt.v, i, a)
+			}
+		}
+	}
+}
+
+func TestParseSlots(t *testing.T) {
+	tests := []struct {
+		s           string
+		first, last int
+		ok          bool
+	}{
+		{"3", 3, 3, true},
+		{"0-7", 0, 7, true},
+		{"$8-$F", 8, 15, true},
+		{"16", 0, 0, false},
+		{"7-3", 0, 0, false},
+		{"x", 0, 0, false},
+	}
+	for _, tt := range tests {
+		first, last, err := parseSlots(tt.s)
+		if (err == nil) != tt.ok || first != tt.first || last != tt.last {
+			t.Errorf("%s: got %v-%v, %v", tt.s, first, last, err)
+		}
+	}
+}
+
+func TestLoadMMUPresets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nico")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	saved := mmuPresets
+	defer func() { mmuPresets = saved }()
+	mmuPresets = map[string]mmuLayout{"ram": mmuBankLayout(0x80)}
+	name := filepath.Join(dir, "presets")
+	text := "# presets\nOFW 0-7=$80 8-11=$80:8000  # forth\nhigh 15=$20\n"
+	if err := ioutil.WriteFile(name, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := loadMMUPresets(name); n != 2 || err != nil {
+		t.Fatalf("loaded %v presets, %v", n, err)
+	}
+	if l := mmuPresets["ofw"]; l[7] != 0x80_7000 || l[8] != 0x80_8000 || l[12] != -1 {
+		t.Errorf("ofw preset is %X", l)
+	}
+	// bad files load nothing
+	tests := []struct {
+		text string
+		err  string
+	}{
+		{"bad\n", "line 1: preset bad sets no slots"},
+		{"bad 0-7\n", "line 1: expected slot=bank, not 0-7"},
+		{"\nbad 0-16=$80\n", "line 2: bad slot 0-16, slots are 0-15"},
+		{"bad 0=$80:8001\n", "line 1: $808001 is not on a 4K boundary"},
+		{"ok 0=$80\nRAM 0-15=$81\n", "line 2: RAM is a built-in preset"},
+	}
+	for _, tt := range tests {
+		if err := ioutil.WriteFile(name, []byte(tt.text), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadMMUPresets(name); err == nil || err.Error() != tt.err {
+			t.Errorf("%q: error %v, want %s", tt.text, err, tt.err)
+		}
+	}
+	if len(mmuPresets) != 3 || mmuPresets["ram"] != mmuBankLayout(0x80) {
+		t.Errorf("presets changed by bad files: %v", mmuPresets)
+	}
+}
@@ -0,0 +1,68 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+// Pseudo-terminals
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Open a pseudo-terminal, returning our end and the other end, which is put
+// in raw mode so that what we write isn't echoed back or translated
+func openPty() (*os.File, *os.File, error) {
+	m, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	name, err := ptyUnlock(m)
+	if err != nil {
+		m.Close()
+		return nil, nil, err
+	}
+	s, err := os.OpenFile(name, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		m.Close()
+		return nil, nil, err
+	}
+	var t syscall.Termios
+	if err = ptyIoctl(s, ptyGetTermios, unsafe.Pointer(&t)); err == nil {
+		t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+			syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+		t.Oflag &^= syscall.OPOST
+		t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+		t.Cflag &^= syscall.CSIZE | syscall.PARENB
+		t.Cflag |= syscall.CS8
+		t.Cc[syscall.VMIN], t.Cc[syscall.VTIME] = 1, 0
+		err = ptyIoctl(s, ptySetTermios, unsafe.Pointer(&t))
+	}
+	if err != nil {
+		s.Close()
+		m.Close()
+		return nil, nil, err
+	}
+	return m, s, nil
+}
+
+// Do an ioctl on a file, without taking it out of non-blocking mode as Fd
+// would
+func ptyIoctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	c, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	err = c.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg))
+	})
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Termios ioctls
+const (
+	ptyGetTermios = syscall.TIOCGETA
+	ptySetTermios = syscall.TIOCSETA
+)
+
+// Unlock the other end of a pseudo-terminal and return its path
+func ptyUnlock(m *os.File) (string, error) {
+	if err := ptyIoctl(m, syscall.TIOCPTYGRANT, nil); err != nil {
+		return "", err
+	}
+	if err := ptyIoctl(m, syscall.TIOCPTYUNLK, nil); err != nil {
+		return "", err
+	}
+	name := make([]byte, 128)
+	if err := ptyIoctl(m, syscall.TIOCPTYGNAME, unsafe.Pointer(&name[0])); err != nil {
+		return "", err
+	}
+	if i := bytes.IndexByte(name, 0); i >= 0 {
+		name = name[:i]
+	}
+	return string(name), nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Termios ioctls
+const (
+	ptyGetTermios = syscall.TCGETS
+	ptySetTermios = syscall.TCSETS
+)
+
+// Unlock the other end of a pseudo-terminal and return its path
+func ptyUnlock(m *os.File) (string, error) {
+	var unlock int32
+	if err := ptyIoctl(m, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err != nil {
+		return "", err
+	}
+	var n uint32
+	if err := ptyIoctl(m, syscall.TIOCGPTN, unsafe.Pointer(&n)); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("/dev/pts/%v", n), nil
+}
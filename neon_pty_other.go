@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// Open a pseudo-terminal, which we only know how to do on Linux and macOS
+func openPty() (*os.File, *os.File, error) {
+	return nil, nil, errors.New("pseudo-terminals are not supported on this system")
+}
@@ -0,0 +1,321 @@
+package main
+
+// Reconnecting devices
+
+// The console and debug devices are wrapped in a reconnector, so that
+// unplugging a USB serial adapter or restarting an emulator doesn't end the
+// session.  When a read or write fails, the reconnector closes the device
+// and reopens it in the background, waiting longer between tries up to a
+// limit.  Meanwhile reads and writes fail with errDisconnected.  Serial
+// adapters are found again by their entry in /dev/serial/by-id, which has
+// their serial number in it, in case they come back as a different tty.
+// The connect and disconnect commands swap the device in a reconnector, so
+// the servicers using it carry on regardless.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Waits between tries at reopening a device
+const (
+	reconnectFirstWait = 250 * time.Millisecond
+	reconnectMaxWait   = 5 * time.Second
+)
+
+// Returned while a device is being reopened, or when there isn't one
+var (
+	errDisconnected = errors.New("disconnected")
+	errNotConnected = errors.New("not connected")
+)
+
+// A device that reopens itself when it fails, and can be swapped for
+// another one
+type reconnector struct {
+	report func(string) // tells the user what's happening
+
+	mu    sync.Mutex
+	name  string                             // device, "" if none
+	open  func() (io.ReadWriteCloser, error) // opens the device
+	speed uint                               // serial speed, 0 if not serial
+	rw    io.ReadWriteCloser                 // nil while reopening
+	up    chan struct{}                      // closed while rw is open
+	gen   int                                // changed by connect and disconnect
+}
+
+// Return a reconnector with no device yet, which reports to report
+func newReconnector(report func(string)) *reconnector {
+	return &reconnector{report: report, up: make(chan struct{})}
+}
+
+// Open a device with open and switch to it, closing the one before.  If it
+// can't be opened we keep the one we had.
+func (r *reconnector) connect(name string, speed uint, open func() (io.ReadWriteCloser, error)) error {
+	rw, err := open()
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.rw != nil {
+		r.rw.Close()
+	} else {
+		close(r.up)
+	}
+	r.name, r.speed, r.open, r.rw = name, speed, open, rw
+	r.gen++
+	return nil
+}
+
+// Close the device and stop reopening it, returning false if there wasn't
+// one
+func (r *reconnector) disconnect() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.name == "" {
+		return false
+	}
+	if r.rw != nil {
+		r.rw.Close()
+		r.up = make(chan struct{})
+	}
+	r.name, r.open, r.rw = "", nil, nil
+	r.gen++
+	return true
+}
+
+// Describe the device and its state
+func (r *reconnector) status() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.name == "" {
+		return "not connected"
+	}
+	s := r.name
+	if r.speed != 0 {
+		s += fmt.Sprintf(" at %v baud", r.speed)
+	}
+	if r.rw == nil {
+		return s + ", disconnected, retrying"
+	}
+	if p, ok := r.rw.(peerNamer); ok {
+		s += ", other end " + p.peer()
+	}
+	return s + ", connected"
+}
+
+// Devices with another end that something else opens, like a
+// pseudo-terminal
+type peerNamer interface {
+	peer() string
+}
+
+// Return the path of the other end of the device, or "" if it hasn't one
+func (r *reconnector) peer() string {
+	rw, _ := r.current()
+	if p, ok := rw.(peerNamer); ok {
+		return p.peer()
+	}
+	return ""
+}
+
+// Return the open device, nil if there isn't one, and a channel closed
+// once there is
+func (r *reconnector) current() (io.ReadWriteCloser, chan struct{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rw, r.up
+}
+
+// Return whether there is a device, even if it's being reopened
+func (r *reconnector) connected() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.name != ""
+}
+
+// Return the serial speed of the device, 0 if it isn't serial
+func (r *reconnector) baud() uint {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.speed
+}
+
+// Wait until the device is open
+func (r *reconnector) wait() {
+	_, up := r.current()
+	<-up
+}
+
+func (r *reconnector) Read(p []byte) (int, error) {
+	rw, _ := r.current()
+	if rw == nil {
+		return 0, r.downError()
+	}
+	n, err := rw.Read(p)
+	if failed(err) {
+		r.fail(rw, err)
+	}
+	return n, err
+}
+
+func (r *reconnector) Write(p []byte) (int, error) {
+	rw, _ := r.current()
+	if rw == nil {
+		return 0, r.downError()
+	}
+	n, err := rw.Write(p)
+	if failed(err) {
+		r.fail(rw, err)
+	}
+	return n, err
+}
+
+// Return the error for reading or writing without an open device
+func (r *reconnector) downError() error {
+	if r.connected() {
+		return errDisconnected
+	}
+	return errNotConnected
+}
+
+// Pass read deadlines on to devices that take them
+func (r *reconnector) SetReadDeadline(t time.Time) error {
+	type deadliner interface {
+		SetReadDeadline(time.Time) error
+	}
+	rw, _ := r.current()
+	if d, ok := rw.(deadliner); ok {
+		return d.SetReadDeadline(t)
+	}
+	return nil
+}
+
+// Return whether an error from a read or write means the device has gone,
+// rather than a timeout
+func failed(err error) bool {
+	var ne interface{ Timeout() bool }
+	return err != nil && !(errors.As(err, &ne) && ne.Timeout())
+}
+
+// Close the device after it failed and start reopening it, unless that has
+// already happened or it has been swapped for another
+func (r *reconnector) fail(rw io.ReadWriteCloser, err error) {
+	r.mu.Lock()
+	if r.rw != rw {
+		r.mu.Unlock()
+		return
+	}
+	rw.Close()
+	r.rw = nil
+	r.up = make(chan struct{})
+	msg := fmt.Sprintf("%s disconnected (%v), retrying", r.name, err)
+	go r.reopen(r.gen, r.name, r.open)
+	r.mu.Unlock()
+	// report may wait on the UI, which mustn't hold up the lock
+	r.report(msg)
+}
+
+// Keep trying to reopen the device, until it's open or the reconnector has
+// moved on to another device
+func (r *reconnector) reopen(gen int, name string, open func() (io.ReadWriteCloser, error)) {
+	wait := reconnectFirstWait
+	for {
+		time.Sleep(wait)
+		r.mu.Lock()
+		current := r.gen == gen
+		r.mu.Unlock()
+		if !current {
+			return
+		}
+		if rw, err := open(); err == nil {
+			r.mu.Lock()
+			if r.gen != gen {
+				r.mu.Unlock()
+				rw.Close()
+				return
+			}
+			r.rw = rw
+			close(r.up)
+			r.mu.Unlock()
+			if p, ok := rw.(peerNamer); ok {
+				name += ", other end " + p.peer()
+			}
+			r.report(fmt.Sprintf("%s reconnected", name))
+			return
+		}
+		if wait *= 2; wait > reconnectMaxWait {
+			wait = reconnectMaxWait
+		}
+	}
+}
+
+// A serial port.  The driver reports a read that timed out as io.EOF, which
+// is also what an unplugged adapter may give, so we look to see if the
+// device is still there.
+type serialPort struct {
+	io.ReadWriteCloser
+	path string
+}
+
+// A read that timed out
+type serialTimeoutError struct{}
+
+func (serialTimeoutError) Error() string { return "read timed out" }
+func (serialTimeoutError) Timeout() bool { return true }
+
+func (s *serialPort) Read(p []byte) (int, error) {
+	n, err := s.ReadWriteCloser.Read(p)
+	if err == io.EOF {
+		if _, serr := os.Stat(s.path); serr == nil {
+			return n, serialTimeoutError{}
+		}
+	}
+	return n, err
+}
+
+// Return a function opening a serial device with open, which finds the
+// adapter again by its serial number if it comes back under another name
+func serialOpener(device string, open func(string) (io.ReadWriteCloser, error)) func() (io.ReadWriteCloser, error) {
+	byID := serialByID(device)
+	return func() (io.ReadWriteCloser, error) {
+		path := device
+		if byID != "" {
+			if p, err := filepath.EvalSymlinks(byID); err == nil {
+				path = p
+			}
+		}
+		c, err := open(path)
+		if err != nil {
+			return nil, err
+		}
+		return &serialPort{c, path}, nil
+	}
+}
+
+// Return the /dev/serial/by-id entry for a serial device, or "" if it
+// doesn't have one
+func serialByID(device string) string {
+	dev, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return ""
+	}
+	const dir = "/dev/serial/by-id"
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	for _, e := range entries {
+		p := filepath.Join(dir, e.Name())
+		if target, err := filepath.EvalSymlinks(p); err == nil && target == dev {
+			return p
+		}
+	}
+	return ""
+}
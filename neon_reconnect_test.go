@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReconnector(t *testing.T) {
+	reports := make(chan string, 4)
+	var r *reconnector
+	r = newReconnector(func(s string) {
+		// reporting may call back into the reconnector, as the UI does
+		reports <- s + "; " + r.status()
+	})
+	if _, err := r.Read(make([]byte, 1)); !errors.Is(err, errNotConnected) {
+		t.Errorf("read with no device gave %v", err)
+	}
+	ends := make(chan net.Conn, 4)
+	open := func() (io.ReadWriteCloser, error) {
+		c, far := net.Pipe()
+		ends <- far
+		return c, nil
+	}
+	if err := r.connect("pipe", 0, open); err != nil {
+		t.Fatal(err)
+	}
+	far := <-ends
+	go far.Write([]byte("x"))
+	b := make([]byte, 1)
+	if n, err := r.Read(b); n != 1 || err != nil || b[0] != 'x' {
+		t.Fatalf("read %q, %v", b[:n], err)
+	}
+	// the far end going away closes the device and starts reopening it
+	far.Close()
+	if _, err := r.Read(b); err == nil {
+		t.Fatal("read from a closed pipe worked")
+	}
+	for _, want := range []string{
+		"pipe disconnected (EOF), retrying; pipe, disconnected, retrying",
+		"pipe reconnected; pipe, connected",
+	} {
+		select {
+		case s := <-reports:
+			if s != want {
+				t.Errorf("reported %q, want %q", s, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no report, want %q", want)
+		}
+	}
+	r.wait()
+	far = <-ends
+	go far.Write([]byte("y"))
+	if n, err := r.Read(b); n != 1 || err != nil || b[0] != 'y' {
+		t.Errorf("read %q after reconnecting, %v", b[:n], err)
+	}
+	if !r.disconnect() || r.disconnect() {
+		t.Error("disconnect didn't report whether there was a device")
+	}
+	if _, err := r.Write(b); !errors.Is(err, errNotConnected) {
+		t.Errorf("write after disconnect gave %v", err)
+	}
+}
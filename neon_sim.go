@@ -0,0 +1,412 @@
+package main
+
+// Neon816 debug port simulator
+
+// This listens on a Unix domain socket and speaks the debug port protocol
+// (see neon_target.go) against a model of the Neon816 memory, so that the
+// debug commands can be developed and tested without a board attached.
+// There is no CPU; stop, go, step and reset only change and log its state.
+//
+// Memory model:
+//   $00:0000-$00:FFFF  mapped through the MMU in 4K slots
+//   $08:0000-$08:001F  MMU registers, low byte then bank of each slot
+//   $20:0000-         flash ROM, an SST39xF040 unless -sim-chip says otherwise
+//   everything else    RAM
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	simChipName = "SST39xF040" // flash ROM part to simulate
+	simBaud     uint           // debug port speed to model, 0 for none
+	simRxBuf    = 64           // receive buffer size to model
+	simLatency  time.Duration  // round trip time to model
+)
+
+const (
+	simMemSize   = 0x100_0000 // 16 MB address space
+	simMMUBank   = 0x08       // bank of the MMU registers
+	simFlashBase = 0x20_0000  // start of flash ROM
+)
+
+// Flash command state machine states
+const (
+	flashRead = iota
+	flashUnlock1
+	flashUnlock2
+	flashEraseSetup
+	flashEraseUnlock1
+	flashEraseUnlock2
+	flashProgram
+)
+
+// Flash operation times, roughly the typical ones for the SST39SF040 except
+// for page writes
+const (
+	simProgramTime = 20 * time.Microsecond
+	simPageTime    = 10 * time.Millisecond
+	simSectorTime  = 18 * time.Millisecond
+	simChipTime    = 70 * time.Millisecond
+)
+
+// A flash ROM
+type simFlash struct {
+	chip      *flashChip      // what we are
+	data      []byte          // contents
+	state     int             // command state
+	idMode    bool            // software ID mode
+	cmdMask   uint32          // address lines decoded for commands
+	page      map[uint32]byte // page being loaded for page written parts
+	pageLast  byte            // last byte loaded into the page
+	busyUntil time.Time       // end of the current program or erase operation
+	busyData  byte            // data being programmed, 0xFF for erase
+	toggle    byte            // DQ6 toggle bit
+}
+
+// Return an erased flash ROM
+func newSimFlash(chip *flashChip) *simFlash {
+	f := &simFlash{
+		chip: chip,
+		data: make([]byte, chip.size),
+	}
+	for f.cmdMask < uint32(chip.cmd1) {
+		f.cmdMask = f.cmdMask<<1 | 1
+	}
+	f.erase(0, uint32(len(f.data)))
+	return f
+}
+
+// Set a range of the flash to 0xFF
+func (f *simFlash) erase(start uint32, n uint32) {
+	for i := start; i < start+n; i++ {
+		f.data[i] = 0xFF
+	}
+}
+
+// Start a program or erase operation which takes d to complete
+func (f *simFlash) busy(d time.Duration, data byte) {
+	f.busyUntil = time.Now().Add(d)
+	f.busyData = data
+}
+
+// Write a loaded page, erasing the rest of it
+func (f *simFlash) commitPage() {
+	if f.page == nil {
+		return
+	}
+	f.erase(f.pageStart(), f.chip.pageSize)
+	for a, v := range f.page {
+		f.data[a] = v
+	}
+	f.page = nil
+	f.state = flashRead
+	f.busy(simPageTime, f.pageLast)
+}
+
+// Read a byte at offset a in the chip
+func (f *simFlash) read(a uint32) byte {
+	f.commitPage()
+	if time.Now().Before(f.busyUntil) {
+		// Status: complement of DQ7 of the data, DQ6 toggling
+		f.toggle ^= 0x40
+		return ^f.busyData&0x80 | f.toggle
+	}
+	if f.idMode {
+		switch a & 1 {
+		case 0:
+			return f.chip.mfr
+		default:
+			return f.chip.dev
+		}
+	}
+	return f.data[a%uint32(len(f.data))]
+}
+
+// Write a byte at offset a in the chip, advancing the state machine
+func (f *simFlash) write(a uint32, v byte) {
+	if time.Now().Before(f.busyUntil) {
+		// Ignored while busy
+		return
+	}
+	a %= uint32(len(f.data))
+	if f.page != nil {
+		if a&^(f.chip.pageSize-1) == f.pageStart() {
+			f.page[a] = v
+			f.pageLast = v
+			return
+		}
+		f.commitPage()
+		return
+	}
+	cmdAddr := a & f.cmdMask
+	cmd1, cmd2 := uint32(f.chip.cmd1), uint32(f.chip.cmd2)
+	state := f.state
+	f.state = flashRead
+	switch state {
+	case flashRead, flashEraseSetup:
+		switch {
+		case v == 0xF0:
+			f.idMode = false
+		case cmdAddr == cmd1 && v == 0xAA:
+			if state == flashEraseSetup {
+				f.state = flashEraseUnlock1
+			} else {
+				f.state = flashUnlock1
+			}
+		}
+	case flashUnlock1:
+		if cmdAddr == cmd2 && v == 0x55 {
+			f.state = flashUnlock2
+		}
+	case flashUnlock2:
+		if cmdAddr != cmd1 {
+			break
+		}
+		switch v {
+		case 0x80:
+			f.state = flashEraseSetup
+		case 0xA0:
+			f.state = flashProgram
+		case 0x90:
+			f.idMode = true
+		case 0xF0:
+			f.idMode = false
+		}
+	case flashEraseUnlock1:
+		if cmdAddr == cmd2 && v == 0x55 {
+			f.state = flashEraseUnlock2
+		}
+	case flashEraseUnlock2:
+		switch {
+		case v == 0x10 && cmdAddr == cmd1:
+			f.erase(0, uint32(len(f.data)))
+			f.busy(simChipTime, 0xFF)
+		case v == 0x30 && f.chip.sectorSize != 0:
+			f.erase(a&^(f.chip.sectorSize-1), f.chip.sectorSize)
+			f.busy(simSectorTime, 0xFF)
+		}
+	case flashProgram:
+		if f.chip.pageSize != 0 {
+			// Start loading a page, which is written by the next read
+			// or write outside the page
+			f.page = map[uint32]byte{a: v}
+			f.pageLast = v
+			return
+		}
+		// Programming can only clear bits
+		f.data[a] &= v
+		f.busy(simProgramTime, v)
+	}
+}
+
+// Return the start of the page being loaded
+func (f *simFlash) pageStart() uint32 {
+	for a := range f.page {
+		return a &^ (f.chip.pageSize - 1)
+	}
+	return 0
+}
+
+// The simulated Neon816
+type neonSim struct {
+	mu      sync.Mutex
+	ram     []byte   // whole address space, flash and MMU excluded
+	mmu     [32]byte // MMU registers
+	flash   *simFlash
+	running bool
+	steps   uint
+	baud    uint          // characters are taken in no faster than this, 0 for no limit
+	rxBuf   int           // characters waiting beyond this are lost
+	overrun int           // characters lost
+	latency time.Duration // how long replies take to come back
+}
+
+// A reply to the debugger and when it is delivered
+type simReply struct {
+	data []byte
+	at   time.Time
+}
+
+// Return a simulator in its power-on state, with the flash ROM mapped into
+// bank 0
+func newNeonSim(chip *flashChip) *neonSim {
+	s := &neonSim{
+		ram:   make([]byte, simMemSize),
+		flash: newSimFlash(chip),
+	}
+	for i := 0; i < 16; i++ {
+		s.mmu[2*i] = byte(i * 16)
+		s.mmu[2*i+1] = simFlashBase >> 16
+	}
+	return s
+}
+
+// Reset the system, which leaves the MMU alone
+func (s *neonSim) reset() {
+	s.steps = 0
+}
+
+// Translate bank 0 addresses through the MMU
+func (s *neonSim) translate(addr uint32) uint32 {
+	addr &= simMemSize - 1
+	if addr>>16 != 0 {
+		return addr
+	}
+	slot := addr >> 12
+	return uint32(s.mmu[2*slot+1])<<16 | uint32(s.mmu[2*slot])<<8 | addr&0xFFF
+}
+
+// Read a byte from the address space
+func (s *neonSim) read(addr uint32) byte {
+	addr = s.translate(addr)
+	switch {
+	case addr>>16 == simMMUBank && addr&0xFFFF < uint32(len(s.mmu)):
+		return s.mmu[addr&0xFFFF]
+	case addr >= simFlashBase && addr < simFlashBase+uint32(len(s.flash.data)):
+		return s.flash.read(addr - simFlashBase)
+	}
+	return s.ram[addr]
+}
+
+// Write a byte to the address space
+func (s *neonSim) write(addr uint32, v byte) {
+	addr = s.translate(addr)
+	switch {
+	case addr>>16 == simMMUBank && addr&0xFFFF < uint32(len(s.mmu)):
+		s.mmu[addr&0xFFFF] = v
+	case addr >= simFlashBase && addr < simFlashBase+uint32(len(s.flash.data)):
+		s.flash.write(addr-simFlashBase, v)
+	default:
+		s.ram[addr] = v
+	}
+}
+
+// Service one debug port connection until it closes.  Replies are sent
+// from another goroutine, which holds each one back for the latency, as a
+// USB serial adapter does, without holding up the commands that follow.
+func (s *neonSim) serve(c net.Conn) {
+	defer c.Close()
+	replies := make(chan simReply, 64)
+	defer close(replies)
+	go func() {
+		for r := range replies {
+			time.Sleep(time.Until(r.at))
+			if _, err := c.Write(r.data); err != nil {
+				// the read below fails and serve returns
+				c.Close()
+			}
+		}
+	}()
+	var value, bank, addr uint32
+	ibuf := make([]byte, 256)
+	waiting, last, overran := 0.0, time.Now(), false // receive buffer model
+	for {
+		n, err := c.Read(ibuf)
+		if err != nil {
+			log.Printf("Connection closed: %v", err)
+			return
+		}
+		var obuf []byte
+		s.mu.Lock()
+		latency := s.latency
+		if s.baud > 0 {
+			// the buffer empties at the port speed, 10 bits a character
+			now := time.Now()
+			waiting -= now.Sub(last).Seconds() * float64(s.baud) / 10
+			if waiting < 0 {
+				waiting = 0
+			}
+			last = now
+			waiting += float64(n)
+			if lost := int(waiting) - s.rxBuf; lost > 0 {
+				if lost > n {
+					lost = n
+				}
+				n -= lost
+				waiting = float64(s.rxBuf)
+				s.overrun += lost
+				if !overran {
+					log.Print("Receive buffer overrun, characters lost")
+					overran = true
+				}
+			}
+		}
+		for _, ch := range ibuf[:n] {
+			switch {
+			case ch >= '0' && ch <= '9':
+				value = value<<4 | uint32(ch-'0')
+			case ch >= 'A' && ch <= 'F':
+				value = value<<4 | uint32(ch-'A'+10)
+			case ch >= 'a' && ch <= 'f':
+				value = value<<4 | uint32(ch-'a'+10)
+			case ch == ':':
+				bank = value & 0xFF
+				value = 0
+			case ch == '#':
+				addr = value & 0xFFFF
+				value = 0
+			case ch == '!':
+				s.write(bank<<16|addr, byte(value))
+				addr = (addr + 1) & 0xFFFF
+				value = 0
+			case ch == '@':
+				obuf = append(obuf, fmt.Sprintf("%02X", s.read(bank<<16|addr))...)
+				addr = (addr + 1) & 0xFFFF
+			case ch == ']':
+				s.running = false
+				log.Print("CPU stopped")
+			case ch == '[':
+				s.running = true
+				log.Print("CPU running")
+			case ch == 'R':
+				s.reset()
+				log.Print("System reset")
+			case ch == 'X':
+				s.steps++
+				log.Printf("CPU step %v", s.steps)
+			}
+		}
+		s.mu.Unlock()
+		if len(obuf) > 0 {
+			replies <- simReply{obuf, time.Now().Add(latency)}
+		}
+	}
+}
+
+// Run the simulator on a Unix domain socket at path, never returns unless
+// something goes wrong
+func runSimulator(path string) error {
+	if path == "" {
+		return fmt.Errorf("no socket path given")
+	}
+	chip := findFlashChipByName(simChipName)
+	if chip == nil {
+		return fmt.Errorf("unknown flash chip %s", simChipName)
+	}
+	// Remove a stale socket from a previous run
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	log.Printf("Neon816 simulator with %v listening on %s", chip, path)
+	s := newNeonSim(chip)
+	s.baud, s.rxBuf, s.latency = simBaud, simRxBuf, simLatency
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		log.Print("Debugger connected")
+		go s.serve(c)
+	}
+}
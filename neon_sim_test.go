@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Write a flash command sequence to the chip
+func simFlashCmds(f *simFlash, cmds ...uint32) {
+	for i := 0; i < len(cmds); i += 2 {
+		f.write(cmds[i], byte(cmds[i+1]))
+	}
+}
+
+// Wait for the chip to finish what it's doing
+func simFlashIdle(f *simFlash) {
+	time.Sleep(time.Until(f.busyUntil))
+}
+
+func TestSimFlashProgram(t *testing.T) {
+	f := newSimFlash(findFlashChipByName("SST39xF040"))
+	// without the unlock sequence, writes do nothing
+	f.write(0x100, 0x12)
+	if v := f.read(0x100); v != 0xFF {
+		t.Fatalf("unlocked write changed the chip to %02X", v)
+	}
+	simFlashCmds(f, 0x5555, 0xAA, 0x2AAA, 0x55, 0x5555, 0xA0, 0x100, 0x12)
+	if v := f.read(0x100); v&0x80 == 0x12&0x80 {
+		t.Errorf("DQ7 gave %02X while programming, want complement of data", v)
+	}
+	simFlashIdle(f)
+	if v := f.read(0x100); v != 0x12 {
+		t.Fatalf("programmed %02X, want 12", v)
+	}
+	// programming can only clear bits
+	simFlashCmds(f, 0x5555, 0xAA, 0x2AAA, 0x55, 0x5555, 0xA0, 0x100, 0x21)
+	simFlashIdle(f)
+	if v := f.read(0x100); v != 0x12&0x21 {
+		t.Errorf("reprogrammed %02X, want %02X", v, 0x12&0x21)
+	}
+	// sector erase
+	simFlashCmds(f, 0x5555, 0xAA, 0x2AAA, 0x55, 0x5555, 0x80, 0x5555, 0xAA, 0x2AAA, 0x55, 0x0000, 0x30)
+	simFlashIdle(f)
+	if v := f.read(0x100); v != 0xFF {
+		t.Errorf("erased sector reads %02X", v)
+	}
+}
+
+func TestSimFlashID(t *testing.T) {
+	chip := findFlashChipByName("Am29F040")
+	f := newSimFlash(chip)
+	// commands at 0x555/0x2AA, so 0x5555/0x2AAA work too
+	simFlashCmds(f, 0x5555, 0xAA, 0x2AAA, 0x55, 0x5555, 0x90)
+	if m, d := f.read(0), f.read(1); m != chip.mfr || d != chip.dev {
+		t.Errorf("ID mode read %02X %02X, want %02X %02X", m, d, chip.mfr, chip.dev)
+	}
+	f.write(0, 0xF0)
+	if v := f.read(0); v != 0xFF {
+		t.Errorf("after reset read %02X, want FF", v)
+	}
+}
+
+func TestSimFlashPage(t *testing.T) {
+	chip := findFlashChipByName("W29C020")
+	f := newSimFlash(chip)
+	f.data[0x85] = 0x00
+	simFlashCmds(f, 0x5555, 0xAA, 0x2AAA, 0x55, 0x5555, 0xA0, 0x80, 0x11, 0x81, 0x22)
+	// the read commits the page, erasing what wasn't loaded
+	f.read(0x80)
+	simFlashIdle(f)
+	if a, b, c := f.read(0x80), f.read(0x81), f.read(0x85); a != 0x11 || b != 0x22 || c != 0xFF {
+		t.Errorf("page reads %02X %02X %02X, want 11 22 FF", a, b, c)
+	}
+}
+
+func TestSimMMU(t *testing.T) {
+	s := newNeonSim(findFlashChipByName("SST39xF040"))
+	// bank 0 starts out mapped to the flash ROM
+	if a := s.translate(0x1234); a != simFlashBase+0x1234 {
+		t.Errorf("$00:1234 maps to $%06X", a)
+	}
+	// map slot 1 to $80:5000
+	s.write(simMMUBank<<16|2, 0x50)
+	s.write(simMMUBank<<16|3, 0x80)
+	s.write(0x1010, 0xAB)
+	if v := s.ram[0x80_5010]; v != 0xAB {
+		t.Errorf("write through slot 1 stored %02X at $80:5010", v)
+	}
+	if v := s.read(0x1010); v != 0xAB {
+		t.Errorf("read through slot 1 gave %02X", v)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+// Symbol tables
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// How far past a symbol an address can be and still be shown relative to it
+const symbolMaxOffset = 0x100
+
+// A named address
+type symbol struct {
+	name string
+	addr uint32
+}
+
+// Symbols loaded by the user, by name and in address order
+type symbolTable struct {
+	byName map[string]uint32
+	byAddr []symbol
+}
+
+// The symbols used by the debug commands
+var symbols = newSymbolTable()
+
+// Return an empty symbol table
+func newSymbolTable() *symbolTable {
+	return &symbolTable{byName: make(map[string]uint32)}
+}
+
+// Add a symbol, replacing any with the same name
+func (st *symbolTable) add(name string, addr uint32) {
+	if old, ok := st.byName[name]; ok {
+		if old == addr {
+			return
+		}
+		for i, s := range st.byAddr {
+			if s.name == name {
+				st.byAddr = append(st.byAddr[:i], st.byAddr[i+1:]...)
+				break
+			}
+		}
+	}
+	st.byName[name] = addr
+	i := sort.Search(len(st.byAddr), func(i int) bool {
+		return st.byAddr[i].addr > addr
+	})
+	st.byAddr = append(st.byAddr, symbol{})
+	copy(st.byAddr[i+1:], st.byAddr[i:])
+	st.byAddr[i] = symbol{name, addr}
+}
+
+// Return the address of a symbol, matching case only if we have to
+func (st *symbolTable) lookup(name string) (uint32, bool) {
+	if addr, ok := st.byName[name]; ok {
+		return addr, true
+	}
+	for n, addr := range st.byName {
+		if strings.EqualFold(n, name) {
+			return addr, true
+		}
+	}
+	return 0, false
+}
+
+// Describe an address as the nearest symbol at or below it, such as main+4,
+// or return "" if there isn't one close enough
+func (st *symbolTable) describe(addr uint32) string {
+	i := sort.Search(len(st.byAddr), func(i int) bool {
+		return st.byAddr[i].addr > addr
+	})
+	if i == 0 {
+		return ""
+	}
+	// first of the symbols at the nearest address
+	s := st.byAddr[i-1]
+	for i--; i > 0 && st.byAddr[i-1].addr == s.addr; i-- {
+		s = st.byAddr[i-1]
+	}
+	switch off := addr - s.addr; {
+	case off == 0:
+		return s.name
+	case off < symbolMaxOffset:
+		return fmt.Sprintf("%s+$%X", s.name, off)
+	}
+	return ""
+}
+
+// Return the symbol exactly at addr, or ""
+func (st *symbolTable) at(addr uint32) string {
+	i := sort.Search(len(st.byAddr), func(i int) bool {
+		return st.byAddr[i].addr >= addr
+	})
+	if i < len(st.byAddr) && st.byAddr[i].addr == addr {
+		return st.byAddr[i].name
+	}
+	return ""
+}
+
+// Load symbols from a file, returning how many there were.  The format is
+// worked out from the contents: ld65 map files, ld65 debug info files, and
+// VICE label files, which is also what ld65 -Ln and the OF816 build write.
+func (st *symbolTable) load(name string) (int, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return 0, err
+	}
+	text := strings.Replace(string(data), "\r\n", "\n", -1)
+	var syms []symbol
+	switch {
+	case strings.Contains(text, "Exports list by name:"):
+		syms, err = parseLd65Map(text)
+	case strings.HasPrefix(text, "version\t"):
+		syms, err = parseLd65Dbg(text)
+	case strings.HasPrefix(text, "al "):
+		syms, err = parseViceLabels(text)
+	default:
+		err = fmt.Errorf("unknown symbol file format")
+	}
+	if err != nil {
+		return 0, err
+	}
+	for _, s := range syms {
+		st.add(s.name, s.addr)
+	}
+	return len(syms), nil
+}
+
+// Parse the exports of an ld65 map file, which are listed two to a line as
+// name, value and flags
+func parseLd65Map(text string) ([]symbol, error) {
+	var syms []symbol
+	lines := strings.Split(text, "\n")
+	for i := 0; i < len(lines); i++ {
+		if strings.TrimSpace(lines[i]) != "Exports list by name:" {
+			continue
+		}
+		// skip the underline
+		for i += 2; i < len(lines) && strings.TrimSpace(lines[i]) != ""; i++ {
+			f := strings.Fields(lines[i])
+			for j := 0; j+1 < len(f); j += 3 {
+				addr, err := strconv.ParseUint(f[j+1], 16, 32)
+				if err != nil {
+					return nil, fmt.Errorf("line %v: bad value %s", i+1, f[j+1])
+				}
+				syms = append(syms, symbol{f[j], uint32(addr) & 0xFF_FFFF})
+			}
+		}
+		break
+	}
+	return syms, nil
+}
+
+// Parse the symbols of an ld65 debug info file, which are lines of
+// key=value pairs such as sym id=0,name="main",...,val=0x8000,...
+func parseLd65Dbg(text string) ([]symbol, error) {
+	var syms []symbol
+	for n, line := range strings.Split(text, "\n") {
+		if !strings.HasPrefix(line, "sym\t") {
+			continue
+		}
+		var name, val string
+		for _, kv := range strings.Split(line[4:], ",") {
+			switch {
+			case strings.HasPrefix(kv, "name="):
+				name = strings.Trim(kv[5:], "\"")
+			case strings.HasPrefix(kv, "val="):
+				val = kv[4:]
+			}
+		}
+		if name == "" || val == "" {
+			// imports have no value
+			continue
+		}
+		addr, err := strconv.ParseUint(val, 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: bad value %s", n+1, val)
+		}
+		syms = append(syms, symbol{name, uint32(addr) & 0xFF_FFFF})
+	}
+	return syms, nil
+}
+
+// Parse a VICE label file, lines of al [C:]address .name
+func parseViceLabels(text string) ([]symbol, error) {
+	var syms []symbol
+	for n, line := range strings.Split(text, "\n") {
+		f := strings.Fields(line)
+		if len(f) < 3 || f[0] != "al" {
+			continue
+		}
+		v := f[1]
+		if i := strings.Index(v, ":"); i >= 0 {
+			v = v[i+1:] // memory space
+		}
+		addr, err := strconv.ParseUint(v, 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: bad address %s", n+1, f[1])
+		}
+		syms = append(syms, symbol{strings.TrimPrefix(f[2], "."), uint32(addr) & 0xFF_FFFF})
+	}
+	return syms, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSymbolParsers(t *testing.T) {
+	tests := []struct {
+		name  string
+		parse func(string) ([]symbol, error)
+		text  string
+		want  []symbol
+		err   string
+	}{
+		{
+			name:  "ld65 map",
+			parse: parseLd65Map,
+			text: "Modules list:\n-------------\nmain.o:\n\n" +
+				"Exports list by name:\n" +
+				"---------------------\n" +
+				"__STACKSIZE__             000800 REA    main                      FF8000 RLA    \n" +
+				"reset                     00FFFC RLA    \n" +
+				"\n" +
+				"Exports list by value:\n" +
+				"----------------------\n" +
+				"__STACKSIZE__             000800 REA    \n",
+			want: []symbol{{"__STACKSIZE__", 0x800}, {"main", 0xFF_8000}, {"reset", 0xFFFC}},
+		},
+		{
+			name:  "ld65 map bad value",
+			parse: parseLd65Map,
+			text:  "Exports list by name:\n---\nmain                      80G0 RLA\n",
+			err:   "line 3: bad value 80G0",
+		},
+		{
+			name:  "ld65 debug info",
+			parse: parseLd65Dbg,
+			text: "version\tmajor=2,minor=0\n" +
+				"sym\tid=0,name=\"main\",addrsize=absolute,scope=0,def=1,ref=2,val=0x8000,seg=0,type=lab\n" +
+				"sym\tid=1,name=\"putc\",addrsize=absolute,scope=0,def=3,type=imp,exp=4\n" +
+				"sym\tid=2,name=\"vec\",addrsize=far,scope=0,def=5,val=0x12FFFC,type=lab\n",
+			want: []symbol{{"main", 0x8000}, {"vec", 0x12_FFFC}},
+		},
+		{
+			name:  "ld65 debug info bad value",
+			parse: parseLd65Dbg,
+			text:  "version\tmajor=2,minor=0\nsym\tid=0,name=\"main\",val=0xZZ\n",
+			err:   "line 2: bad value 0xZZ",
+		},
+		{
+			name:  "VICE labels",
+			parse: parseViceLabels,
+			text:  "al C:8000 .main\nal 00FFFC .reset\n\nbreak 8000\nal 12:3456 .far\n",
+			want:  []symbol{{"main", 0x8000}, {"reset", 0xFFFC}, {"far", 0x3456}},
+		},
+		{
+			name:  "VICE labels bad address",
+			parse: parseViceLabels,
+			text:  "al C:8000 .main\nal C:XYZ .bad\n",
+			err:   "line 2: bad address C:XYZ",
+		},
+	}
+	for _, tt := range tests {
+		got, err := tt.parse(tt.text)
+		switch {
+		case tt.err != "":
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: error %v, want %s", tt.name, err, tt.err)
+			}
+		case err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case !reflect.DeepEqual(got, tt.want):
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSymbolTable(t *testing.T) {
+	st := newSymbolTable()
+	st.add("main", 0x8000)
+	st.add("loop", 0x8010)
+	st.add("Start", 0x8000)
+	st.add("buf", 0x9000)
+	st.add("buf", 0x2000) // moves
+	if a, ok := st.lookup("START"); !ok || a != 0x8000 {
+		t.Errorf("lookup START gave $%X, %v", a, ok)
+	}
+	if _, ok := st.lookup("nothing"); ok {
+		t.Error("lookup found a symbol that isn't there")
+	}
+	tests := []struct {
+		addr     uint32
+		describe string
+		at       string
+	}{
+		{0x1FFF, "", ""},
+		{0x2000, "buf", "buf"},
+		{0x8000, "main", "main"},
+		{0x8004, "main+$4", ""},
+		{0x8010, "loop", "loop"},
+		{0x810F, "loop+$FF", ""},
+		{0x8110, "", ""},
+		{0x9000, "", ""},
+	}
+	for _, tt := range tests {
+		if d, a := st.describe(tt.addr), st.at(tt.addr); d != tt.describe || a != tt.at {
+			t.Errorf("$%X: described %q, at %q, want %q, %q", tt.addr, d, a, tt.describe, tt.at)
+		}
+	}
+}
+
+func TestSymbolLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nico")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := []struct {
+		text string
+		n    int
+		err  bool
+	}{
+		{"al C:8000 .main\r\nal C:8010 .loop\r\n", 2, false},
+		{"version\tmajor=2,minor=0\nsym\tid=0,name=\"x\",val=0x10\n", 1, false},
+		{"main = $8000\n", 0, true},
+	}
+	for i, f := range files {
+		name := filepath.Join(dir, fmt.Sprintf("syms%v", i))
+		if err := ioutil.WriteFile(name, []byte(f.text), 0644); err != nil {
+			t.Fatal(err)
+		}
+		n, err := newSymbolTable().load(name)
+		if n != f.n || (err != nil) != f.err {
+			t.Errorf("%q: loaded %v, %v", f.text, n, err)
+		}
+	}
+}
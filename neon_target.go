@@ -0,0 +1,691 @@
+package main
+
+// Neon816 debug port protocol
+
+// The debug port understands a handful of single-character commands.
+// Hex digits are accumulated into a value, which is then consumed by one of:
+//   :  set the bank for subsequent accesses
+//   #  set the 16-bit address within the bank
+//   !  write the value as a byte to the address, then advance the address
+//   @  read the byte at the address as two hex digits, then advance
+// as well as the CPU controls:
+//   ]  stop   [  go   R  reset   X  single step
+//
+// neonTarget wraps an io.ReadWriter connected to the debug port and provides
+// methods which return results and errors rather than writing to the UI, so
+// that anything can drive a Neon816 with it.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// Errors returned by neonTarget methods
+
+// The debug port did not reply in time
+type targetTimeoutError struct {
+	Op   string // what we were doing
+	Addr uint32 // where we were doing it
+}
+
+func (e *targetTimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out at $%06X", e.Op, e.Addr)
+}
+
+// The debug port replied with something other than a hex byte
+type targetParseError struct {
+	Addr  uint32 // address being read
+	Reply []byte // what we got back
+}
+
+func (e *targetParseError) Error() string {
+	return fmt.Sprintf("bad reply %q reading $%06X", e.Reply, e.Addr)
+}
+
+// The operation was aborted by closing the target's cancel channel
+var errTargetAborted = errors.New("aborted")
+
+// A frame read got back something other than the two hex bytes expected,
+// so the debug port is out of step
+type targetSyncError struct {
+	Reply []byte // what the frame read got back
+}
+
+func (e *targetSyncError) Error() string {
+	if len(e.Reply) == 0 {
+		return "no reply to frame read"
+	}
+	return fmt.Sprintf("debug port out of step, frame read got %q", e.Reply)
+}
+
+// An address given to an operation is not suitably aligned
+type targetAlignError struct {
+	Addr  uint32 // address given
+	Align uint32 // required alignment
+}
+
+func (e *targetAlignError) Error() string {
+	return fmt.Sprintf("address $%06X is not aligned to $%X", e.Addr, e.Align)
+}
+
+// Default time to wait for a reply from the debug port
+const targetReplyTimeout = 2 * time.Second
+
+// Default number of characters written to the debug port at once.  When
+// pacing, no more than this are sent ahead of what the Neon has taken in,
+// so it must fit in its receive buffer.
+const targetChunkSize = 32
+
+// Default number of reads to have in flight at once.  Each is a single @,
+// so these have to fit in the receive buffer too.
+const targetReadWindow = 16
+
+// Default number of times a read that got a bad or missing reply is retried,
+// after getting back in step with the debug port
+const targetRetries = 3
+
+// Where frame reads come from: the MMU registers for slot 1, which read the
+// same each time, unlike RAM the CPU may be writing or a busy flash chip.
+// Their four hex digits are unlikely to be all the same, so that the reply
+// to a frame read is different if it is shifted by a character.  Only the
+// simulator is known to read them back, so framing is off unless asked for.
+const targetFrameAddr = mmuRegisters + 2
+
+// Where Sync reads a byte from to check that the port answers, when reads
+// aren't framed: RAM, which can always be read
+const targetProbeAddr = 0x80_0000
+
+// Most characters drain will discard, in case they never stop coming
+const targetDrainMax = 4096
+
+// How long a flash program operation may take before we give up on it.
+// Erase times vary a lot more by part, see neon_flash.go.
+const flashProgramTimeout = 100 * time.Millisecond
+
+// A Neon816 connected via its debug port
+type neonTarget struct {
+	rw      io.ReadWriter   // debug port
+	speed   uint            // debug port speed for pacing, 0 = no pacing
+	chunk   int             // characters to write at once
+	window  int             // reads to have in flight at once
+	retries int             // times to retry a read after a bad reply
+	retried int             // reads retried, for the caller to report
+	framed  bool            // frame memory reads with reads of the frame registers
+	frame   []byte          // reply to the last good frame read, nil if not known
+	timeout time.Duration   // how long to wait for replies
+	out     []byte          // characters waiting to be written
+	idle    time.Time       // when the Neon should have taken in what was written
+	err     error           // first write error since last flush
+	cancel  <-chan struct{} // closed to abort long operations, may be nil
+}
+
+// Return a target talking over rw, pacing characters for the given speed
+func newNeonTarget(rw io.ReadWriter, speed uint) *neonTarget {
+	return &neonTarget{
+		rw:      rw,
+		speed:   speed,
+		chunk:   targetChunkSize,
+		window:  targetReadWindow,
+		retries: targetRetries,
+		timeout: targetReplyTimeout,
+	}
+}
+
+// Stop execution
+func (t *neonTarget) Stop() error {
+	t.send("]")
+	return t.flush()
+}
+
+// Continue execution
+func (t *neonTarget) Go() error {
+	t.send("[")
+	return t.flush()
+}
+
+// Execute a single instruction
+func (t *neonTarget) Step() error {
+	t.send("X")
+	return t.flush()
+}
+
+// Reset the system
+func (t *neonTarget) Reset() error {
+	t.send("R")
+	return t.flush()
+}
+
+// Reset the system and begin execution
+func (t *neonTarget) Run() error {
+	t.send("]R[")
+	return t.flush()
+}
+
+// Read n bytes of memory starting at addr, crossing banks as needed.  After
+// a bad or missing reply we get back in step and carry on from the last
+// good byte, up to the retry limit.
+func (t *neonTarget) ReadMemory(addr uint32, n int) ([]byte, error) {
+	buf, err := t.readMemory(addr, n)
+	for try := 0; try < t.retries && retryable(err); try++ {
+		t.retried++
+		if _, err = t.Sync(); err != nil {
+			continue
+		}
+		var more []byte
+		more, err = t.readMemory((addr+uint32(len(buf)))&0xFF_FFFF, n-len(buf))
+		buf = append(buf, more...)
+	}
+	return buf, err
+}
+
+// Read memory for ReadMemory.  Up to a window of reads are sent ahead of
+// the replies, so that we aren't waiting on the round trip for every byte,
+// and the window is topped up in one write once half of it has been read.
+// If framed, the reads are framed by reads of the frame registers, which
+// must match each other and what they were last time, or else a character
+// was lost or a stray one got in somewhere and none of the data can be
+// trusted.
+func (t *neonTarget) readMemory(addr uint32, n int) ([]byte, error) {
+	if n == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, n)
+	window := t.window
+	if window < 1 {
+		window = 1
+	}
+	var frame []byte
+	if t.framed {
+		t.sendFrame()
+		t.sendAddr(addr)
+		if err := t.flush(); err != nil {
+			return nil, err
+		}
+		var err error
+		if frame, err = t.readFrame(t.frame); err != nil {
+			t.drain()
+			return nil, err
+		}
+		t.frame = frame
+	} else {
+		t.sendAddr(addr)
+	}
+	sent := 0
+	for i := range buf {
+		if err := t.aborted(); err != nil {
+			t.drain()
+			return buf[:i], err
+		}
+		if sent < n && sent-i <= window/2 {
+			for ; sent < n && sent-i < window; sent++ {
+				a := (addr + uint32(sent)) & 0xFF_FFFF
+				if sent != 0 && a&0xFFFF == 0 {
+					// roll over to next bank
+					t.sendAddr(a)
+				}
+				t.send("@")
+				if sent == n-1 && t.framed {
+					t.sendFrame()
+				}
+			}
+			if err := t.flush(); err != nil {
+				return nil, err
+			}
+		}
+		b, err := t.readHex((addr + uint32(i)) & 0xFF_FFFF)
+		if err != nil {
+			// don't leave replies to the reads in flight for the next
+			// operation to trip over
+			t.drain()
+			return nil, err
+		}
+		buf[i] = b
+	}
+	if t.framed {
+		if _, err := t.readFrame(frame); err != nil {
+			t.drain()
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// Write data to memory starting at addr, crossing banks as needed
+func (t *neonTarget) WriteMemory(addr uint32, data []byte) error {
+	if addr < targetFrameAddr+2 && addr+uint32(len(data)) > targetFrameAddr {
+		// the frame registers will read differently now
+		t.frame = nil
+	}
+	t.sendAddr(addr)
+	for i, b := range data {
+		if err := t.aborted(); err != nil {
+			t.flush()
+			return err
+		}
+		a := (addr + uint32(i)) & 0xFF_FFFF
+		if i != 0 && a&0xFFFF == 0 {
+			// roll over to next bank
+			t.sendAddr(a)
+		}
+		t.sendHex(uint(b), 2)
+		t.send("!")
+	}
+	return t.flush()
+}
+
+// Program data into an erased flash ROM starting at addr.  Since the erased
+// chip is all 0xFF, we don't write those, which speeds up flashing.  Parts
+// which are written a page at a time erase the page as they go, so a partly
+// covered page loses whatever data isn't supplied, and a page of 0xFF is
+// only skipped if erased says the chip was erased beforehand.  Aborting
+// stops between bytes or pages, once the chip has finished the last one.
+func (t *neonTarget) ProgramFlash(c *flashChip, addr uint32, data []byte, erased bool) error {
+	if c.pageSize != 0 {
+		return t.programFlashPages(c, addr, data, erased)
+	}
+	t.sendBank(uint(addr >> 16))
+	for i, b := range data {
+		a := (addr + uint32(i)) & 0xFF_FFFF
+		if i != 0 && a&0xFFFF == 0 {
+			// roll over to next bank
+			t.sendBank(uint(a >> 16))
+		}
+		if err := t.aborted(); err != nil {
+			t.flush()
+			return err
+		}
+		if b != 0xFF {
+			t.sendCmd(c.cmd1, 0xAA)
+			t.sendCmd(c.cmd2, 0x55)
+			t.sendCmd(c.cmd1, 0xA0)
+			t.sendCmd(uint(a&0xFFFF), uint(b))
+			if err := t.flashWait("program", a, b, flashProgramTimeout); err != nil {
+				return err
+			}
+		}
+	}
+	return t.flush()
+}
+
+// Program data a page at a time, skipping pages that are all 0xFF if the
+// chip was erased
+func (t *neonTarget) programFlashPages(c *flashChip, addr uint32, data []byte, erased bool) error {
+	for len(data) > 0 {
+		n := int(c.pageSize - addr&(c.pageSize-1))
+		if n > len(data) {
+			n = len(data)
+		}
+		page := data[:n]
+		blank := erased
+		for _, b := range page {
+			blank = blank && b == 0xFF
+		}
+		if err := t.aborted(); err != nil {
+			t.flush()
+			return err
+		}
+		if !blank {
+			t.sendBank(uint(addr >> 16))
+			t.sendCmd(c.cmd1, 0xAA)
+			t.sendCmd(c.cmd2, 0x55)
+			t.sendCmd(c.cmd1, 0xA0)
+			t.sendHex(uint(addr&0xFFFF), 4)
+			t.send("#")
+			for _, b := range page {
+				t.sendHex(uint(b), 2)
+				t.send("!")
+			}
+			last := len(page) - 1
+			if err := t.flashWait("program", addr+uint32(last), page[last], flashProgramTimeout); err != nil {
+				return err
+			}
+		}
+		addr += uint32(n)
+		data = data[n:]
+	}
+	return t.flush()
+}
+
+// Stop and reset the system, then erase the flash chip in the given bank
+func (t *neonTarget) EraseChip(c *flashChip, bank uint8) error {
+	t.send("]R")
+	t.sendBank(uint(bank))
+	t.sendCmd(c.cmd1, 0xAA)
+	t.sendCmd(c.cmd2, 0x55)
+	t.sendCmd(c.cmd1, 0x80)
+	t.sendCmd(c.cmd1, 0xAA)
+	t.sendCmd(c.cmd2, 0x55)
+	t.sendCmd(c.cmd1, 0x10)
+	return t.flashWait("erase", uint32(bank)<<16, 0xFF, c.chipTimeout)
+}
+
+// Stop the system and erase the flash sector at sa.  The chip is assumed to
+// be aligned to its size.
+func (t *neonTarget) EraseSector(c *flashChip, sa uint32) error {
+	if c.sectorSize == 0 {
+		return fmt.Errorf("%s has no sector erase", c.name)
+	}
+	if sa&(c.sectorSize-1) != 0 {
+		return &targetAlignError{Addr: sa, Align: c.sectorSize}
+	}
+	t.send("]")
+	t.sendBank(uint(sa&^(c.size-1)) >> 16)
+	t.sendCmd(c.cmd1, 0xAA)
+	t.sendCmd(c.cmd2, 0x55)
+	t.sendCmd(c.cmd1, 0x80)
+	t.sendCmd(c.cmd1, 0xAA)
+	t.sendCmd(c.cmd2, 0x55)
+	t.sendBank(uint(sa >> 16))
+	t.sendCmd(uint(sa&0xFFFF), 0x30)
+	return t.flashWait("erase", sa, 0xFF, c.sectorTimeout)
+}
+
+// Stop the system and return the manufacturer and device IDs of the flash
+// chip in the given bank
+func (t *neonTarget) ChipID(bank uint8) (uint8, uint8, error) {
+	t.send("]")
+	t.sendBank(uint(bank))
+	// Software ID mode enter
+	t.sendCmd(0x5555, 0xAA)
+	t.sendCmd(0x2AAA, 0x55)
+	t.sendCmd(0x5555, 0x90)
+	// Now read the ID bytes
+	id, err := t.ReadMemory(uint32(bank)<<16, 2)
+	// Software ID mode exit, even if reading failed
+	if ferr := t.ResetFlash(bank); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return id[0], id[1], nil
+}
+
+// Put the flash chip in the given bank back in read mode, which is the
+// software ID exit command.  Parts which take their commands at 0x555/0x2AA
+// ignore the higher address lines, and accept F0 on its own as a reset.
+func (t *neonTarget) ResetFlash(bank uint8) error {
+	t.sendBank(uint(bank))
+	t.sendCmd(0x5555, 0xAA)
+	t.sendCmd(0x2AAA, 0x55)
+	t.sendCmd(0x5555, 0xF0)
+	return t.flush()
+}
+
+// Discard anything waiting to be read from the debug port, returning the
+// number of bytes discarded
+func (t *neonTarget) Resync() int {
+	save := t.timeout
+	t.timeout = 100 * time.Millisecond
+	defer func() { t.timeout = save }()
+	buf, _ := t.readReply(16)
+	return len(buf)
+}
+
+// Discard everything waiting to be read from the debug port, returning the
+// number of bytes discarded
+func (t *neonTarget) drain() int {
+	n := 0
+	for n < targetDrainMax {
+		c := t.Resync()
+		if c == 0 {
+			break
+		}
+		n += c
+	}
+	return n
+}
+
+// Get back in step with the debug port.  Anything waiting is discarded, then
+// two frame reads are made in one go, and must match, or if reads aren't
+// framed a byte is read to see that the port answers.  Returns the number
+// of bytes discarded.  This changes the current address.
+func (t *neonTarget) Sync() (int, error) {
+	n := t.drain()
+	t.frame = nil
+	if !t.framed {
+		t.sendAddr(targetProbeAddr)
+		t.send("@")
+		if err := t.flush(); err != nil {
+			return n, err
+		}
+		if _, err := t.readHex(targetProbeAddr); err != nil {
+			t.drain()
+			return n, err
+		}
+		return n, nil
+	}
+	t.sendFrame()
+	t.sendFrame()
+	if err := t.flush(); err != nil {
+		return n, err
+	}
+	frame, err := t.readFrame(nil)
+	if err == nil {
+		_, err = t.readFrame(frame)
+	}
+	if err != nil {
+		t.drain()
+		return n, err
+	}
+	t.frame = frame
+	return n, nil
+}
+
+// Send a frame read
+func (t *neonTarget) sendFrame() {
+	t.sendAddr(targetFrameAddr)
+	t.send("@@")
+}
+
+// Read the reply to a frame read, which must be two hex bytes matching want
+// if that's not nil
+func (t *neonTarget) readFrame(want []byte) ([]byte, error) {
+	reply, err := t.readReply(4)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	_, perr := strconv.ParseUint(string(reply), 16, 16)
+	if len(reply) < 4 || perr != nil || want != nil && !bytes.Equal(reply, want) {
+		return nil, &targetSyncError{Reply: reply}
+	}
+	return reply, nil
+}
+
+// Return whether getting back in step with the debug port might cure err
+func retryable(err error) bool {
+	var te *targetTimeoutError
+	var pe *targetParseError
+	var se *targetSyncError
+	return errors.As(err, &te) || errors.As(err, &pe) || errors.As(err, &se)
+}
+
+// Send characters to the debug port.  They are buffered and written a chunk
+// at a time, and the rest go when flush is called.  Errors are remembered
+// and returned by the next flush.
+func (t *neonTarget) send(s string) {
+	t.out = append(t.out, s...)
+	t.write(false)
+}
+
+// Send l hex digits of v
+func (t *neonTarget) sendHex(v uint, l uint) {
+	for i := uint(0); i < l; i++ {
+		n := (v >> (4 * (l - i - 1))) & 0xF
+		t.out = append(t.out, "0123456789ABCDEF"[n])
+	}
+	t.write(false)
+}
+
+// Write whole chunks of the buffered characters, or all of them.  When
+// pacing, each chunk waits until the Neon should have taken in the one
+// before, going by the port speed and the time that has passed, so that we
+// never have more than a chunk in its receive buffer.
+func (t *neonTarget) write(all bool) {
+	chunk := t.chunk
+	if chunk < 1 {
+		chunk = 1
+	}
+	for len(t.out) >= chunk || all && len(t.out) > 0 {
+		n := chunk
+		if n > len(t.out) {
+			n = len(t.out)
+		}
+		if t.err == nil {
+			if t.speed > 0 {
+				time.Sleep(time.Until(t.idle))
+			}
+			_, t.err = t.rw.Write(t.out[:n])
+			if t.speed > 0 {
+				// 10 bits a character
+				t.idle = time.Now().Add(time.Duration(n) * 10 * time.Second / time.Duration(t.speed))
+			}
+		}
+		t.out = t.out[:copy(t.out, t.out[n:])]
+	}
+}
+
+// Select the bank for subsequent accesses
+func (t *neonTarget) sendBank(bank uint) {
+	t.sendHex(bank, 2)
+	t.send(":")
+}
+
+// Select a full 24-bit address for subsequent accesses
+func (t *neonTarget) sendAddr(addr uint32) {
+	t.sendBank(uint(addr >> 16))
+	t.sendHex(uint(addr), 4)
+	t.send("#")
+}
+
+// Write a byte to an address in the current bank
+func (t *neonTarget) sendCmd(addr uint, dat uint) {
+	t.sendHex(addr, 4)
+	t.send("#")
+	t.sendHex(dat, 2)
+	t.send("!")
+}
+
+// Write out anything buffered, and return and clear any error from sending
+func (t *neonTarget) flush() error {
+	t.write(true)
+	err := t.err
+	t.err = nil
+	return err
+}
+
+// Return errTargetAborted if the cancel channel has been closed
+func (t *neonTarget) aborted() error {
+	select {
+	case <-t.cancel:
+		return errTargetAborted
+	default:
+		return nil
+	}
+}
+
+// Wait for a flash program or erase operation at addr to complete, using
+// data polling.  While the operation is in progress, the chip returns the
+// complement of bit 7 of the data being written (DQ7), which is 1 for an
+// erase.  Once DQ7 is right we read again, since the other bits may become
+// valid after DQ7 does.  The current bank must be the bank of addr.
+func (t *neonTarget) flashWait(op string, addr uint32, want byte, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		t.sendHex(uint(addr&0xFFFF), 4)
+		t.send("#")
+		b, err := t.readByte(addr)
+		if err != nil {
+			return err
+		}
+		if b&0x80 == want&0x80 {
+			t.sendHex(uint(addr&0xFFFF), 4)
+			t.send("#")
+			_, err = t.readByte(addr)
+			return err
+		}
+		if time.Now().After(deadline) {
+			return &targetTimeoutError{Op: op, Addr: addr}
+		}
+	}
+}
+
+// Read the byte at the current address, which must be addr.  After a bad or
+// missing reply we get back in step and read addr again, up to the retry
+// limit.  These reads are never framed, to keep flash polling quick, so a
+// stray character that looks like hex is only noticed by the next framed
+// read, if there is one.
+func (t *neonTarget) readByte(addr uint32) (byte, error) {
+	t.send("@")
+	err := t.flush()
+	var b byte
+	if err == nil {
+		b, err = t.readHex(addr)
+	}
+	for try := 0; try < t.retries && retryable(err); try++ {
+		t.retried++
+		if _, err = t.Sync(); err != nil {
+			continue
+		}
+		t.sendAddr(addr)
+		t.send("@")
+		if err = t.flush(); err == nil {
+			b, err = t.readHex(addr)
+		}
+	}
+	return b, err
+}
+
+// Read the two hex digit reply to a @, addr is used for error reporting
+func (t *neonTarget) readHex(addr uint32) (byte, error) {
+	reply, err := t.readReply(2)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return 0, &targetTimeoutError{Op: "read", Addr: addr}
+		}
+		return 0, err
+	}
+	i, err := strconv.ParseUint(string(reply), 16, 8)
+	if err != nil {
+		return 0, &targetParseError{Addr: addr, Reply: reply}
+	}
+	return byte(i), nil
+}
+
+// Read exactly n characters from the debug port, however many reads that
+// takes.  Sockets block forever, so we give each read a deadline, which is
+// how serial ports behave.  Serial ports time out and return no data, which
+// is reported as io.EOF.
+func (t *neonTarget) readReply(n int) ([]byte, error) {
+	type deadliner interface {
+		SetReadDeadline(time.Time) error
+	}
+	d, ok := t.rw.(deadliner)
+	if ok {
+		defer d.SetReadDeadline(time.Time{})
+	}
+	buf := make([]byte, n)
+	got := 0
+	for got < n {
+		if ok {
+			d.SetReadDeadline(time.Now().Add(t.timeout))
+		}
+		c, err := t.rw.Read(buf[got:])
+		got += c
+		if err != nil {
+			var ne interface{ Timeout() bool }
+			if errors.As(err, &ne) && ne.Timeout() {
+				return buf[:got], io.EOF
+			}
+			return buf[:got], err
+		}
+		if c == 0 {
+			return buf[:got], io.EOF
+		}
+	}
+	return buf, nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// the simulator logs every command
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+// Start the simulator with the given flash part on a Unix domain socket, and
+// return a target talking to it
+func simTarget(t *testing.T, chip string) (*neonTarget, *neonSim) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "nico")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	l, err := net.Listen("unix", filepath.Join(dir, "sim.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	s := newNeonSim(findFlashChipByName(chip))
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	c, err := net.Dial("unix", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return newNeonTarget(c, 0), s
+}
+
+func TestTargetReadWrite(t *testing.T) {
+	tg, s := simTarget(t, "SST39xF040")
+	data := make([]byte, 300)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	// crosses from bank $80 into $81
+	const addr = 0x80_FF80
+	if err := tg.WriteMemory(addr, data); err != nil {
+		t.Fatal(err)
+	}
+	for _, framed := range []bool{false, true} {
+		for _, window := range []int{1, 4, 16, 64} {
+			tg.framed, tg.window = framed, window
+			got, err := tg.ReadMemory(addr, len(data))
+			if err != nil {
+				t.Fatalf("framed %v, window %v: %v", framed, window, err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("framed %v, window %v: read back % X", framed, window, got[:16])
+			}
+		}
+	}
+	if tg.retried != 0 {
+		t.Errorf("%v reads retried", tg.retried)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !bytes.Equal(s.ram[addr:addr+len(data)], data) {
+		t.Error("simulator memory doesn't match what was written")
+	}
+}
+
+// A debug port that counts writes
+type countingConn struct {
+	net.Conn
+	writes int
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	c.writes++
+	return c.Conn.Write(b)
+}
+
+func TestTargetReadWindow(t *testing.T) {
+	tg, s := simTarget(t, "SST39xF040")
+	s.mu.Lock()
+	s.latency = 5 * time.Millisecond
+	s.mu.Unlock()
+	c := &countingConn{Conn: tg.rw.(net.Conn)}
+	tg.rw = c
+	const n = 256
+	start := time.Now()
+	if _, err := tg.ReadMemory(0x80_0000, n); err != nil {
+		t.Fatal(err)
+	}
+	// the window is topped up a half at a time, not a read at a time
+	if max := 2*n/tg.window + 4; c.writes > max {
+		t.Errorf("%v writes for %v reads, want at most %v", c.writes, n, max)
+	}
+	// and the round trip is waited out once for each batch, not each byte
+	if elapsed := time.Since(start); elapsed > n*5*time.Millisecond/4 {
+		t.Errorf("reading took %v with 5ms latency", elapsed)
+	}
+}
+
+func TestTargetSync(t *testing.T) {
+	tg, _ := simTarget(t, "SST39xF040")
+	for _, framed := range []bool{false, true} {
+		tg.framed = framed
+		// a read whose reply is never collected
+		tg.sendAddr(0x80_0000)
+		tg.send("@")
+		if err := tg.flush(); err != nil {
+			t.Fatal(err)
+		}
+		n, err := tg.Sync()
+		if err != nil {
+			t.Fatalf("framed %v: %v", framed, err)
+		}
+		if n != 2 {
+			t.Errorf("framed %v: discarded %v bytes, want 2", framed, n)
+		}
+		if framed && tg.frame == nil {
+			t.Errorf("frame not known after Sync")
+		}
+	}
+}
+
+func TestTargetCPU(t *testing.T) {
+	tg, s := simTarget(t, "SST39xF040")
+	for _, f := range []func() error{tg.Go, tg.Step, tg.Step, tg.Stop} {
+		if err := f(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a read makes sure the simulator has seen everything
+	if _, err := tg.ReadMemory(0x80_0000, 1); err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running || s.steps != 2 {
+		t.Errorf("running %v after %v steps, want stopped after 2", s.running, s.steps)
+	}
+}
+
+func TestTargetFlash(t *testing.T) {
+	for _, name := range []string{"SST39xF040", "W29C020"} {
+		t.Run(name, func(t *testing.T) {
+			tg, _ := simTarget(t, name)
+			chip := findFlashChipByName(name)
+			mfr, dev, err := tg.ChipID(flashBank)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mfr != chip.mfr || dev != chip.dev {
+				t.Fatalf("ChipID gave %02X %02X, want %02X %02X", mfr, dev, chip.mfr, chip.dev)
+			}
+			if err := tg.EraseChip(chip, flashBank); err != nil {
+				t.Fatal(err)
+			}
+			data := []byte("Neon816 flash test\xFF\x00\x01")
+			const addr = flashBank<<16 | 0x1000
+			if err := tg.ProgramFlash(chip, addr, data, true); err != nil {
+				t.Fatal(err)
+			}
+			got, err := tg.ReadMemory(addr, len(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("read back %q, want %q", got, data)
+			}
+		})
+	}
+}
+
+func TestTargetFlashBlankPage(t *testing.T) {
+	tg, _ := simTarget(t, "W29C020")
+	chip := findFlashChipByName("W29C020")
+	const addr = flashBank<<16 | 0x0100
+	blank := bytes.Repeat([]byte{0xFF}, int(chip.pageSize))
+	for _, erased := range []bool{true, false} {
+		if err := tg.ProgramFlash(chip, addr, []byte{1, 2, 3}, true); err != nil {
+			t.Fatal(err)
+		}
+		if err := tg.ProgramFlash(chip, addr, blank, erased); err != nil {
+			t.Fatal(err)
+		}
+		got, err := tg.ReadMemory(addr, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a blank page is only skipped when the chip is known to be erased
+		want := blank[:3]
+		if erased {
+			want = []byte{1, 2, 3}
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("erased %v: read back % X, want % X", erased, got, want)
+		}
+	}
+}
+
+func TestTargetEraseSector(t *testing.T) {
+	tg, _ := simTarget(t, "SST39xF040")
+	chip := findFlashChipByName("SST39xF040")
+	const addr = flashBank<<16 | 0x2000
+	if err := tg.ProgramFlash(chip, addr, []byte{1, 2, 3}, true); err != nil {
+		t.Fatal(err)
+	}
+	var ae *targetAlignError
+	if err := tg.EraseSector(chip, addr+1); !errors.As(err, &ae) {
+		t.Fatalf("unaligned erase gave %v, want an alignment error", err)
+	}
+	if err := tg.EraseSector(chip, addr); err != nil {
+		t.Fatal(err)
+	}
+	got, err := tg.ReadMemory(addr, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, []byte{0xFF, 0xFF, 0xFF}) {
+		t.Fatalf("sector not erased, read % X", got)
+	}
+}
+
+func TestTargetErrors(t *testing.T) {
+	// a debug port that takes everything and never replies
+	c, far := net.Pipe()
+	defer c.Close()
+	defer far.Close()
+	go ioutil.ReadAll(far)
+	tg := newNeonTarget(c, 0)
+	tg.timeout = 20 * time.Millisecond
+	_, err := tg.ReadMemory(0x80_0000, 4)
+	if !retryable(err) {
+		t.Errorf("read without replies gave %v, want a retryable error", err)
+	}
+	if tg.retried != tg.retries {
+		t.Errorf("retried %v times, want %v", tg.retried, tg.retries)
+	}
+	cancel := make(chan struct{})
+	close(cancel)
+	tg.cancel = cancel
+	if err := tg.WriteMemory(0x80_0000, []byte{1}); !errors.Is(err, errTargetAborted) {
+		t.Errorf("aborted write gave %v", err)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+// Transports
+
+// The console and debug devices are given as URIs, whose scheme picks the
+// transport that reaches them:
+//   serial:/dev/ttyUSB0?baud=115200&parity=n&flow=rtscts
+//   unix:/tmp/neon.sock
+//   tcp:host:port, such as a ser2net box
+//   pty: or pty:/tmp/neon, a pseudo-terminal for an emulator to open
+//   exec:./emulator --args, talking to its standard input and output
+// A plain path is a serial device or Unix domain socket, whichever it is.
+// Unix domain sockets and TCP take baud too, to pace writes for a serial
+// line at the far end, and a baud rate given to connect paces the other
+// transports the same way.
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jacobsa/go-serial/serial"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long to wait for a TCP connection
+const transportDialTimeout = 5 * time.Second
+
+// A transport returns a function opening a device, given as the rest of its
+// URI, and its speed for pacing writes, 0 for none.  baud is the speed
+// asked for, 0 if none was, and options has the defaults for serial
+// devices.
+type transport func(device string, baud uint, options serial.OpenOptions) (func() (io.ReadWriteCloser, error), uint, error)
+
+// Transports by URI scheme
+var transports = map[string]transport{
+	"serial": serialTransport,
+	"unix":   unixTransport,
+	"tcp":    tcpTransport,
+	"pty":    ptyTransport,
+	"exec":   execTransport,
+}
+
+// Return a function opening the device a URI names, and its speed for
+// pacing writes
+func openTransport(uri string, baud uint, options serial.OpenOptions) (func() (io.ReadWriteCloser, error), uint, error) {
+	if i := strings.IndexByte(uri, ':'); i > 0 {
+		if tr, ok := transports[strings.ToLower(uri[:i])]; ok {
+			return tr(strings.TrimPrefix(uri[i+1:], "//"), baud, options)
+		}
+	}
+	return pathTransport(uri, baud, options)
+}
+
+// A plain path, to a Unix domain socket or a serial device
+func pathTransport(device string, baud uint, options serial.OpenOptions) (func() (io.ReadWriteCloser, error), uint, error) {
+	fi, err := os.Stat(device)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch {
+	case fi.Mode()&os.ModeSocket != 0:
+		return unixTransport(device, baud, options)
+	case fi.Mode()&os.ModeDevice != 0:
+		if baud != 0 {
+			options.BaudRate = baud
+		}
+		return serialDevice(device, options), options.BaudRate, nil
+	}
+	return nil, 0, fmt.Errorf("%s is not a socket or serial device", device)
+}
+
+// A serial device, with its settings as parameters
+func serialTransport(device string, baud uint, options serial.OpenOptions) (func() (io.ReadWriteCloser, error), uint, error) {
+	if baud != 0 {
+		options.BaudRate = baud
+	}
+	path, err := transportParams(device, &options, "baud", "parity", "flow", "databits", "stopbits")
+	if err != nil {
+		return nil, 0, err
+	}
+	return serialDevice(path, options), options.BaudRate, nil
+}
+
+// Return a function opening a serial device with options
+func serialDevice(device string, options serial.OpenOptions) func() (io.ReadWriteCloser, error) {
+	return serialOpener(device, func(path string) (io.ReadWriteCloser, error) {
+		options.PortName = path
+		return serial.Open(options)
+	})
+}
+
+// A Unix domain socket
+func unixTransport(device string, baud uint, _ serial.OpenOptions) (func() (io.ReadWriteCloser, error), uint, error) {
+	params := serial.OpenOptions{BaudRate: baud}
+	path, err := transportParams(device, &params, "baud")
+	if err != nil {
+		return nil, 0, err
+	}
+	return func() (io.ReadWriteCloser, error) {
+		return net.Dial("unix", path)
+	}, params.BaudRate, nil
+}
+
+// A TCP connection
+func tcpTransport(device string, baud uint, _ serial.OpenOptions) (func() (io.ReadWriteCloser, error), uint, error) {
+	params := serial.OpenOptions{BaudRate: baud}
+	addr, err := transportParams(device, &params, "baud")
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, 0, err
+	}
+	return func() (io.ReadWriteCloser, error) {
+		return net.DialTimeout("tcp", addr, transportDialTimeout)
+	}, params.BaudRate, nil
+}
+
+// Split a device from its ?name=value parameters, applying them to options.
+// Only the allowed parameters may be given.
+func transportParams(device string, options *serial.OpenOptions, allowed ...string) (string, error) {
+	i := strings.IndexByte(device, '?')
+	if i < 0 {
+		return device, nil
+	}
+	q, err := url.ParseQuery(device[i+1:])
+	if err != nil {
+		return "", err
+	}
+	for name, vs := range q {
+		ok := false
+		for _, a := range allowed {
+			ok = ok || name == a
+		}
+		if !ok {
+			return "", fmt.Errorf("unknown parameter %s", name)
+		}
+		v := strings.ToLower(vs[len(vs)-1])
+		n, nerr := strconv.ParseUint(v, 10, 32)
+		switch name {
+		case "baud":
+			if nerr != nil || n == 0 {
+				return "", fmt.Errorf("bad baud rate %s", v)
+			}
+			options.BaudRate = uint(n)
+		case "databits":
+			if nerr != nil || n < 5 || n > 8 {
+				return "", fmt.Errorf("bad data bits %s, 5 to 8", v)
+			}
+			options.DataBits = uint(n)
+		case "stopbits":
+			if nerr != nil || n < 1 || n > 2 {
+				return "", fmt.Errorf("bad stop bits %s, 1 or 2", v)
+			}
+			options.StopBits = uint(n)
+		case "parity":
+			switch v {
+			case "n", "none":
+				options.ParityMode = serial.PARITY_NONE
+			case "o", "odd":
+				options.ParityMode = serial.PARITY_ODD
+			case "e", "even":
+				options.ParityMode = serial.PARITY_EVEN
+			default:
+				return "", fmt.Errorf("bad parity %s, n, o or e", v)
+			}
+		case "flow":
+			switch v {
+			case "none":
+				options.RTSCTSFlowControl = false
+			case "rtscts":
+				options.RTSCTSFlowControl = true
+			default:
+				return "", fmt.Errorf("bad flow control %s, none or rtscts", v)
+			}
+		}
+	}
+	return device[:i], nil
+}
+
+// A pseudo-terminal, with a symbolic link to it if a path is given
+func ptyTransport(link string, baud uint, _ serial.OpenOptions) (func() (io.ReadWriteCloser, error), uint, error) {
+	return func() (io.ReadWriteCloser, error) {
+		return openPtyPort(link)
+	}, baud, nil
+}
+
+// A pseudo-terminal for an emulator to open.  We keep the emulator's end
+// open as well, so that the emulator can come and go without it going away.
+type ptyPort struct {
+	*os.File          // our end
+	slave    *os.File // the emulator's end
+	link     string   // symbolic link to the emulator's end, if any
+}
+
+// Open a pseudo-terminal, making a symbolic link to it unless link is ""
+func openPtyPort(link string) (io.ReadWriteCloser, error) {
+	m, s, err := openPty()
+	if err != nil {
+		return nil, err
+	}
+	p := &ptyPort{m, s, link}
+	if link != "" {
+		// replace an old link, but nothing else
+		if fi, err := os.Lstat(link); err == nil && fi.Mode()&os.ModeSymlink == 0 {
+			p.Close()
+			return nil, fmt.Errorf("%s is in the way", link)
+		}
+		os.Remove(link)
+		if err := os.Symlink(s.Name(), link); err != nil {
+			p.Close()
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func (p *ptyPort) Close() error {
+	if target, err := os.Readlink(p.link); err == nil && target == p.slave.Name() {
+		os.Remove(p.link)
+	}
+	p.slave.Close()
+	return p.File.Close()
+}
+
+// The path the emulator opens
+func (p *ptyPort) peer() string {
+	return p.slave.Name()
+}
+
+// A command run through the shell, which is restarted if it exits
+func execTransport(command string, baud uint, _ serial.OpenOptions) (func() (io.ReadWriteCloser, error), uint, error) {
+	if strings.TrimSpace(command) == "" {
+		return nil, 0, errors.New("no command to run")
+	}
+	return func() (io.ReadWriteCloser, error) {
+		cmd := exec.Command("sh", "-c", command)
+		in, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+		return &execPort{cmd, in, out}, nil
+	}, baud, nil
+}
+
+// A running command's standard input and output
+type execPort struct {
+	cmd *exec.Cmd
+	in  io.WriteCloser
+	out io.ReadCloser
+}
+
+func (p *execPort) Read(b []byte) (int, error)  { return p.out.Read(b) }
+func (p *execPort) Write(b []byte) (int, error) { return p.in.Write(b) }
+
+// Stop the command
+func (p *execPort) Close() error {
+	p.in.Close()
+	p.cmd.Process.Kill()
+	p.cmd.Wait()
+	return nil
+}
+
+// Pass read deadlines on to the pipe, so the debug port can time out
+func (p *execPort) SetReadDeadline(t time.Time) error {
+	if f, ok := p.out.(*os.File); ok {
+		return f.SetReadDeadline(t)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"github.com/jacobsa/go-serial/serial"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTransportParams(t *testing.T) {
+	defaults := serial.OpenOptions{BaudRate: 57600, DataBits: 8, StopBits: 1}
+	all := []string{"baud", "parity", "flow", "databits", "stopbits"}
+	tests := []struct {
+		device  string
+		allowed []string
+		path    string
+		want    serial.OpenOptions
+		err     string
+	}{
+		{"/dev/ttyUSB0", all, "/dev/ttyUSB0", defaults, ""},
+		{"/dev/ttyUSB0?baud=115200", all, "/dev/ttyUSB0",
+			serial.OpenOptions{BaudRate: 115200, DataBits: 8, StopBits: 1}, ""},
+		{"/dev/ttyUSB0?parity=E&databits=7&stopbits=2&flow=RTSCTS", all, "/dev/ttyUSB0",
+			serial.OpenOptions{BaudRate: 57600, DataBits: 7, StopBits: 2,
+				ParityMode: serial.PARITY_EVEN, RTSCTSFlowControl: true}, ""},
+		{"/dev/ttyUSB0?baud=9600&baud=19200", all, "/dev/ttyUSB0",
+			serial.OpenOptions{BaudRate: 19200, DataBits: 8, StopBits: 1}, ""},
+		{"/tmp/neon.sock?baud=9600", []string{"baud"}, "/tmp/neon.sock",
+			serial.OpenOptions{BaudRate: 9600, DataBits: 8, StopBits: 1}, ""},
+		{"/tmp/neon.sock?parity=n", []string{"baud"}, "", defaults, "unknown parameter parity"},
+		{"/dev/ttyUSB0?baud=0", all, "", defaults, "bad baud rate 0"},
+		{"/dev/ttyUSB0?baud=fast", all, "", defaults, "bad baud rate fast"},
+		{"/dev/ttyUSB0?databits=9", all, "", defaults, "bad data bits 9, 5 to 8"},
+		{"/dev/ttyUSB0?stopbits=3", all, "", defaults, "bad stop bits 3, 1 or 2"},
+		{"/dev/ttyUSB0?parity=m", all, "", defaults, "bad parity m, n, o or e"},
+		{"/dev/ttyUSB0?flow=xon", all, "", defaults, "bad flow control xon, none or rtscts"},
+		{"/dev/ttyUSB0?baud=%zz", all, "", defaults, `invalid URL escape "%zz"`},
+	}
+	for _, tt := range tests {
+		options := defaults
+		path, err := transportParams(tt.device, &options, tt.allowed...)
+		switch {
+		case tt.err != "":
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: error %v, want %s", tt.device, err, tt.err)
+			}
+		case err != nil:
+			t.Errorf("%s: %v", tt.device, err)
+		case path != tt.path || options != tt.want:
+			t.Errorf("%s: got %s, %+v, want %s, %+v", tt.device, path, options, tt.path, tt.want)
+		}
+	}
+}
+
+func TestOpenTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nico")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "neon.sock")
+	ul, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range []net.Listener{ul, tl} {
+		defer l.Close()
+		go func(l net.Listener) {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				c.Close()
+			}
+		}(l)
+	}
+	options := serial.OpenOptions{BaudRate: 57600}
+	tests := []struct {
+		uri   string
+		baud  uint
+		speed uint
+		ok    bool
+	}{
+		{sock, 0, 0, true},
+		{sock, 9600, 9600, true},
+		{"unix:" + sock, 0, 0, true},
+		{"UNIX://" + sock + "?baud=19200", 0, 19200, true},
+		{"unix:" + sock + "?baud=19200", 9600, 19200, true},
+		{"tcp:" + tl.Addr().String() + "?baud=9600", 0, 9600, true},
+		{"tcp://" + tl.Addr().String(), 0, 0, true},
+		{"tcp:localhost", 0, 0, false},
+		{"exec:", 0, 0, false},
+		{filepath.Join(dir, "missing"), 0, 0, false},
+		{dir, 0, 0, false},
+	}
+	for _, tt := range tests {
+		open, speed, err := openTransport(tt.uri, tt.baud, options)
+		if err == nil {
+			var c interface{ Close() error }
+			if c, err = open(); err == nil {
+				c.Close()
+			}
+		}
+		if (err == nil) != tt.ok || err == nil && speed != tt.speed {
+			t.Errorf("%s at %v: speed %v, %v", tt.uri, tt.baud, speed, err)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+// Verification reports
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// How many expected/actual pairs to show for each range of differences
+const verifyPairsShown = 4
+
+// A contiguous run of bytes that differ from what was expected
+type verifyRange struct {
+	addr     uint32 // start address
+	expected []byte // what the image says
+	actual   []byte // what we read back
+}
+
+// Differences found while verifying memory against an image
+type verifyReport struct {
+	compared int           // bytes compared
+	ranges   []verifyRange // runs of differences, in address order
+}
+
+// Compare what was read from addr with what was expected
+func (r *verifyReport) compare(addr uint32, expected, actual []byte) {
+	for i, b := range actual {
+		r.compared++
+		if b == expected[i] {
+			continue
+		}
+		a := addr + uint32(i)
+		if n := len(r.ranges); n > 0 {
+			last := &r.ranges[n-1]
+			if last.addr+uint32(len(last.expected)) == a {
+				last.expected = append(last.expected, expected[i])
+				last.actual = append(last.actual, b)
+				continue
+			}
+		}
+		r.ranges = append(r.ranges, verifyRange{
+			addr:     a,
+			expected: []byte{expected[i]},
+			actual:   []byte{b},
+		})
+	}
+}
+
+// Return the number of bytes that differ
+func (r *verifyReport) mismatches() int {
+	n := 0
+	for _, rg := range r.ranges {
+		n += len(rg.expected)
+	}
+	return n
+}
+
+// Describe the differences for the user
+func (r *verifyReport) summary() string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("%v of %v bytes differ in %v range%s:\n",
+		r.mismatches(), r.compared, len(r.ranges), plural(len(r.ranges))))
+	for _, rg := range r.ranges {
+		n := len(rg.expected)
+		sb.WriteString(fmt.Sprintf("  $%06X-$%06X, %v byte%s, expected/actual:",
+			rg.addr, rg.addr+uint32(n)-1, n, plural(n)))
+		for i := 0; i < n && i < verifyPairsShown; i++ {
+			sb.WriteString(fmt.Sprintf(" %02X/%02X", rg.expected[i], rg.actual[i]))
+		}
+		if n > verifyPairsShown {
+			sb.WriteString(" ...")
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// Write every difference to a file, one per line as address, expected and
+// actual bytes in hex
+func (r *verifyReport) saveDiff(name string) error {
+	file, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	fmt.Fprintf(w, "# %v of %v bytes differ in %v range%s\n",
+		r.mismatches(), r.compared, len(r.ranges), plural(len(r.ranges)))
+	fmt.Fprintf(w, "# address expected actual\n")
+	for _, rg := range r.ranges {
+		for i := range rg.expected {
+			fmt.Fprintf(w, "%06X %02X %02X\n", rg.addr+uint32(i), rg.expected[i], rg.actual[i])
+		}
+	}
+	err = w.Flush()
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Return "s" unless n is 1
+func plural(n int) string {
+	if n == 1 {
+		return ""
+	}
+	return "s"
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestVerifyReport(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+		actual   []string // read back in pieces
+		summary  string
+	}{
+		{
+			name:     "match",
+			expected: "abcdefgh",
+			actual:   []string{"abcd", "efgh"},
+			summary:  "0 of 8 bytes differ in 0 ranges:\n",
+		},
+		{
+			name:     "one byte",
+			expected: "abcdefgh",
+			actual:   []string{"abcdXfgh"},
+			summary: "1 of 8 bytes differ in 1 range:\n" +
+				"  $001004-$001004, 1 byte, expected/actual: 65/58\n",
+		},
+		{
+			name:     "run across reads",
+			expected: "abcdefgh",
+			actual:   []string{"abXX", "XXXh"},
+			summary: "5 of 8 bytes differ in 1 range:\n" +
+				"  $001002-$001006, 5 bytes, expected/actual: 63/58 64/58 65/58 66/58 ...\n",
+		},
+		{
+			name:     "two ranges",
+			expected: "abcdefgh",
+			actual:   []string{"Xbcd", "efgY"},
+			summary: "2 of 8 bytes differ in 2 ranges:\n" +
+				"  $001000-$001000, 1 byte, expected/actual: 61/58\n" +
+				"  $001007-$001007, 1 byte, expected/actual: 68/59\n",
+		},
+	}
+	for _, tt := range tests {
+		r := &verifyReport{}
+		addr := uint32(0x1000)
+		for _, a := range tt.actual {
+			r.compare(addr, []byte(tt.expected[addr-0x1000:]), []byte(a))
+			addr += uint32(len(a))
+		}
+		if s := r.summary(); s != tt.summary {
+			t.Errorf("%s: summary\n%s\nwant\n%s", tt.name, s, tt.summary)
+		}
+	}
+}
+
+func TestVerifyShortRead(t *testing.T) {
+	// a read cut short only compares what came back
+	r := &verifyReport{}
+	r.compare(0x2000, []byte{1, 2, 3, 4}, []byte{1, 9})
+	want := []verifyRange{{0x2001, []byte{2}, []byte{9}}}
+	if r.compared != 2 || !reflect.DeepEqual(r.ranges, want) {
+		t.Errorf("compared %v with ranges %v, want 2 with %v", r.compared, r.ranges, want)
+	}
+}
+
+func TestVerifySaveDiff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nico")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r := &verifyReport{}
+	r.compare(0x20_0000, []byte{1, 2, 3, 4}, []byte{1, 0xF2, 0xF3, 4})
+	name := filepath.Join(dir, "diff.txt")
+	if err := r.saveDiff(name); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# 2 of 4 bytes differ in 1 range\n" +
+		"# address expected actual\n" +
+		"200001 02 F2\n" +
+		"200002 03 F3\n"
+	if string(got) != want {
+		t.Errorf("diff file\n%s\nwant\n%s", got, want)
+	}
+}
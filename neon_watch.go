@@ -0,0 +1,200 @@
+package main
+
+// Watched memory
+
+// Watches are re-read every so often and after each command, and shown in a
+// pane above the command line with values that changed recently highlighted.
+// Nothing is read while a command is running, so long operations like flash
+// have the port to themselves; the pane says so.
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const (
+	watchMax         = 8 // most watches, one pane line each
+	watchMaxLen      = 64
+	watchInterval    = 500 * time.Millisecond // how often watches are read
+	watchHighlighted = time.Second            // how long a change stays highlighted
+)
+
+// A way of showing watched memory
+type watchFormat struct {
+	name string
+	size int // bytes per value
+}
+
+var watchFormats = []watchFormat{{"byte", 1}, {"word", 2}, {"long", 3}, {"ascii", 1}}
+
+// A watched piece of memory
+type watch struct {
+	addr    uint32
+	length  int
+	format  watchFormat
+	last    []byte      // memory when last read, nil before the first read
+	changed []time.Time // when each value last changed
+}
+
+// What the watch pane shows, sent to the UI, with changed values
+// highlighted.  No lines means no pane.
+type watchPane struct {
+	title string
+	lines [][]paneSpan
+}
+
+// Watch state, for the debug goroutine
+var (
+	watches   []*watch   // in the order they were added
+	watchSent *watchPane // what the UI was sent last
+)
+
+// Add a watch, or list them
+func debugWatch(args []string) {
+	args = nonEmpty(args)
+	if len(args) == 0 {
+		if len(watches) == 0 {
+			debugOutputChan <- "No watches\n"
+		}
+		for i, w := range watches {
+			debugOutputChan <- fmt.Sprintf("%3v  %s, %v bytes as %s\n", i+1, describeAddr(w.addr), w.length, w.format.name)
+		}
+		return
+	}
+	addr, err := parseAddr(args[0])
+	if err != nil {
+		debugOutputChan <- fmt.Sprintf("Bad address: %s\n", args[0])
+		return
+	}
+	w := &watch{addr: addr, format: watchFormats[0]}
+	for _, a := range args[1:] {
+		if f, ok := findWatchFormat(a); ok {
+			w.format = f
+			continue
+		}
+		n, err := evalExpr(a)
+		if err != nil || n < 1 || n > watchMaxLen {
+			debugOutputChan <- fmt.Sprintf("Bad length: %s (1-%v bytes)\n", a, watchMaxLen)
+			return
+		}
+		w.length = int(n)
+	}
+	if w.length == 0 {
+		w.length = w.format.size
+	}
+	if w.length%w.format.size != 0 {
+		debugOutputChan <- fmt.Sprintf("Length must be a multiple of %v for %s!\n", w.format.size, w.format.name)
+		return
+	}
+	if len(watches) == watchMax {
+		debugOutputChan <- fmt.Sprintf("Too many watches, at most %v!\n", watchMax)
+		return
+	}
+	watches = append(watches, w)
+	debugOutputChan <- fmt.Sprintf("Watch %v at %s\n", len(watches), describeAddr(addr))
+}
+
+// Remove watches by number, or all of them
+func debugUnwatch(args []string) {
+	args = nonEmpty(args)
+	if len(args) == 0 {
+		watches = nil
+		debugOutputChan <- "Removed all watches\n"
+		return
+	}
+	remove := make(map[int]bool)
+	for _, a := range args {
+		n, err := evalExpr(a)
+		if err != nil || n < 1 || n > int64(len(watches)) {
+			debugOutputChan <- fmt.Sprintf("No watch %s!\n", a)
+			return
+		}
+		remove[int(n)-1] = true
+	}
+	for _, a := range args {
+		debugOutputChan <- fmt.Sprintf("Removed watch %s\n", a)
+	}
+	var kept []*watch
+	for i, w := range watches {
+		if !remove[i] {
+			kept = append(kept, w)
+		}
+	}
+	watches = kept
+}
+
+// Return the format with the given name
+func findWatchFormat(name string) (watchFormat, bool) {
+	for _, f := range watchFormats {
+		if strings.EqualFold(f.name, name) {
+			return f, true
+		}
+	}
+	return watchFormat{}, false
+}
+
+// Read the watches and update the pane
+func debugPollWatches(t *neonTarget) {
+	pane := &watchPane{title: "Watch"}
+	now := time.Now()
+	for i, w := range watches {
+		line := []paneSpan{{fmt.Sprintf("%v %s: ", i+1, describeAddr(w.addr)), false}}
+		data, err := t.ReadMemory(w.addr, w.length)
+		if err != nil {
+			pane.lines = append(pane.lines, append(line, paneSpan{"(read error)", false}))
+			continue
+		}
+		if w.changed == nil {
+			w.changed = make([]time.Time, w.length/w.format.size)
+		}
+		for j := range w.changed {
+			v := data[j*w.format.size : (j+1)*w.format.size]
+			if w.last != nil && !bytes.Equal(v, w.last[j*w.format.size:(j+1)*w.format.size]) {
+				w.changed[j] = now
+			}
+			if j > 0 && w.format.name != "ascii" {
+				line = append(line, paneSpan{" ", false})
+			}
+			line = append(line, paneSpan{formatWatchValue(w.format, v), now.Sub(w.changed[j]) < watchHighlighted})
+		}
+		w.last = data
+		pane.lines = append(pane.lines, line)
+	}
+	watchSend(pane)
+}
+
+// Show that the watches aren't being read while a command runs
+func watchPause() {
+	if len(watches) > 0 && watchSent != nil {
+		pane := *watchSent
+		pane.title = "Watch (paused)"
+		watchSend(&pane)
+	}
+}
+
+// Send the pane to the UI, if it has changed
+func watchSend(pane *watchPane) {
+	if watchSent == nil && len(pane.lines) == 0 || reflect.DeepEqual(pane, watchSent) {
+		return
+	}
+	watchSent = pane
+	watchOutputChan <- pane
+}
+
+// Format a value, which is little-endian
+func formatWatchValue(f watchFormat, v []byte) string {
+	if f.name == "ascii" {
+		if v[0] < 0x20 || v[0] > 0x7E {
+			return "."
+		}
+		return string(v[0])
+	}
+	n := 0
+	for i := len(v) - 1; i >= 0; i-- {
+		n = n<<8 | int(v[i])
+	}
+	return fmt.Sprintf("%0*X", 2*len(v), n)
+}
@@ -14,6 +14,11 @@ var (
 	commandCursor      = 0               // cursor position in command string
 	consoleWindow      *goncurses.Window // console window
 	activeWindow       *goncurses.Window // current active input window
+	rootWindow         *goncurses.Window // whole screen
+	watchWindow        *goncurses.Window // watch pane, nil when not shown
+	watchHeight        = 0               // rows taken from the debug window by the watch pane
+	memeditWindow      *goncurses.Window // memory editor, over the debug window while open
+	memeditReturn      *goncurses.Window // active window before the memory editor opened
 )
 
 // All screen/keyboard I/O is done in this function, to be used as
@@ -26,6 +31,10 @@ func uiServicer() {
 			consoleWriteAnsi(s)
 		case s := <-debugOutputChan:
 			debugWrite(s)
+		case p := <-watchOutputChan:
+			watchWrite(p)
+		case m := <-memeditOutputChan:
+			memeditWrite(m)
 		default:
 			k := activeWindow.GetChar()
 			if k != 0 {
@@ -38,6 +47,10 @@ func uiServicer() {
 // Routine to service all keypresses received in the UI
 // regardless of the active Curses window.
 func serviceKey(k goncurses.Key) {
+	if memeditWindow != nil {
+		memeditServiceKey(k)
+		return
+	}
 	switch k {
 	case 0:
 		// nothing
@@ -47,7 +60,15 @@ func serviceKey(k goncurses.Key) {
 		l := activeWindow.GetChar()
 		switch l {
 		case 0:
-			consoleInputChan <- k
+			if activeWindow == commandInputWindow {
+				// abort the running job, if any
+				select {
+				case debugAbortChan <- true:
+				default:
+				}
+			} else {
+				consoleInputChan <- k
+			}
 		case 9: // Alt+Tab
 			swapWindow()
 		case 32: // Alt+Space
@@ -198,7 +219,7 @@ func commandLineInput(k goncurses.Key) {
 		}
 	} else {
 		// an input character
-		l = l + string(k)
+		l = l + string(rune(k))
 	}
 	commandCursor = len(l)
 	commandString = l + r
@@ -235,7 +256,9 @@ func processCommandLine(cl string) {
 	if ct == "" {
 		return
 	}
-	debugOutputChan <- fmt.Sprintf("> %s\n", ct)
+	// written directly rather than queued, since a busy job may have filled
+	// the debug output channel that we drain
+	debugWrite(fmt.Sprintf("> %s\n", ct))
 	r := csv.NewReader(strings.NewReader(ct))
 	r.Comma = ' '
 	r.Comment = '#'
@@ -245,7 +268,7 @@ func processCommandLine(cl string) {
 		// there is only one line.
 		errs := strings.SplitN(fmt.Sprintf("%v", err), ": ", 2)
 		errn := len(errs) - 1
-		debugOutputChan <- fmt.Sprintf("Command syntax error: %v!\n", errs[errn])
+		debugWrite(fmt.Sprintf("Command syntax error: %v!\n", errs[errn]))
 		return
 	}
 	switch strings.ToLower(words[0]) {
@@ -319,8 +342,9 @@ func keyboardCommand() bool {
 
 // Puts the help text in the debug window
 func helpText() {
-	debugOutputChan <- "Help: F1=help; F2 or alt+tab=swap console/debug; F10=quit, ^]=command\n"
-	debugOutputChan <- "  commands: tab=swap, [c]lear console, clear [d]ebug, [h]elp, [q]uit\n"
+	debugWrite("Help: F1=help; F2 or alt+tab=swap console/debug; F10=quit, ^]=command\n")
+	debugWrite("  commands: tab=swap, [c]lear console, clear [d]ebug, [h]elp, [q]uit\n")
+	debugWrite("  in the command window, Esc=abort job\n")
 }
 
 // Swaps the active input window, note the debug input window is
@@ -341,13 +365,183 @@ func debugWrite(args ...interface{}) {
 	}
 	goncurses.NewLines(true)
 	debugWindow.Print(args...)
-	debugWindow.Refresh()
+	if memeditWindow == nil {
+		debugWindow.Refresh()
+	}
 	goncurses.NewLines(false)
 	if activeWindow != debugWindow {
 		fixCursor()
 	}
 }
 
+// Part of a line of text for a pane, possibly highlighted
+type paneSpan struct {
+	text   string
+	hilite bool
+}
+
+// Draw a line of spans on row y of a window, cut off to fit
+func drawSpans(w *goncurses.Window, y int, line []paneSpan) {
+	_, cols := w.MaxYX()
+	w.Move(y, 0)
+	x := 0
+	for _, span := range line {
+		text := span.text
+		if x+len(text) > cols-1 {
+			if x >= cols-1 {
+				break
+			}
+			text = text[:cols-1-x]
+		}
+		if span.hilite {
+			w.AttrOn(goncurses.A_REVERSE)
+		}
+		w.Print(text)
+		w.AttrOff(goncurses.A_REVERSE)
+		x += len(text)
+	}
+}
+
+// Show the watch pane above the command input, taking the rows it needs
+// from the bottom of the debug window
+func watchWrite(p *watchPane) {
+	if debugWindow == nil {
+		return
+	}
+	rows, cols := debugWindow.MaxYX()
+	rows += watchHeight
+	h := 0
+	if len(p.lines) > 0 {
+		// title line, and leave the debug window a few rows
+		h = imin(len(p.lines)+1, rows-3)
+		if h < 2 {
+			// no room for the title and a line, so hide the pane
+			h = 0
+		}
+	}
+	if h != watchHeight {
+		watchResize(h, rows, cols)
+	}
+	if watchWindow == nil {
+		return
+	}
+	watchWindow.Erase()
+	watchWindow.HLine(0, 0, goncurses.ACS_HLINE, cols)
+	watchWindow.MovePrint(0, 2, " "+p.title+" ")
+	for i, line := range p.lines[:h-1] {
+		drawSpans(watchWindow, i+1, line)
+	}
+	watchWindow.Refresh()
+	fixCursor()
+}
+
+// Give the watch pane h rows of the debug area, which is rows by cols
+func watchResize(h, rows, cols int) {
+	if watchWindow != nil {
+		watchWindow.Delete()
+		watchWindow = nil
+	}
+	y, x := debugWindow.CursorYX()
+	if d := h - watchHeight; d > 0 {
+		// keep the latest output in view
+		debugWindow.Scroll(d)
+		y -= d
+		if y < 0 {
+			y = 0
+		}
+	}
+	debugWindow.Resize(rows-h, cols)
+	for r := rows - watchHeight; r < rows-h; r++ {
+		// rows the pane gave back
+		debugWindow.Move(r, 0)
+		debugWindow.ClearToEOL()
+	}
+	debugWindow.Move(y, x)
+	if memeditWindow == nil {
+		debugWindow.Refresh()
+	}
+	ysize, _ := rootWindow.MaxYX()
+	if h > 0 {
+		watchWindow = rootWindow.Derived(h, cols, ysize-1-h, 0)
+	}
+	watchHeight = h
+}
+
+// Show the memory editor over the debug window, opening or closing it as
+// needed
+func memeditWrite(m *memeditScreen) {
+	if m.done {
+		if memeditWindow != nil {
+			memeditWindow.Delete()
+			memeditWindow = nil
+			activeWindow = memeditReturn
+			debugWindow.Touch()
+			debugWindow.Refresh()
+			fixCursor()
+		}
+		return
+	}
+	if debugWindow == nil {
+		return
+	}
+	rows, cols := debugWindow.MaxYX()
+	if memeditWindow == nil {
+		y, x := debugWindow.YX()
+		w, err := goncurses.NewWindow(rows, cols, y, x)
+		if err != nil {
+			debugWrite(fmt.Sprintf("Cannot open memory editor: %v\n", err))
+			memeditSend(memeditInput{key: 0x1B})
+			return
+		}
+		w.Keypad(true)
+		w.Timeout(50)
+		memeditWindow = w
+		memeditReturn = activeWindow
+		activeWindow = w
+	} else if r, c := memeditWindow.MaxYX(); r != rows || c != cols {
+		// the watch pane has changed size
+		memeditWindow.Resize(rows, cols)
+	}
+	if m.rows != rows {
+		// ask for a screen that fits
+		memeditSend(memeditInput{rows: rows})
+	}
+	memeditWindow.Erase()
+	for y, line := range m.lines {
+		if y < rows {
+			drawSpans(memeditWindow, y, line)
+		}
+	}
+	memeditWindow.Move(m.curY, m.curX)
+	memeditWindow.Touch()
+	memeditWindow.Refresh()
+}
+
+// Pass a key to the memory editor
+func memeditServiceKey(k goncurses.Key) {
+	rows, _ := memeditWindow.MaxYX()
+	switch k {
+	case goncurses.KEY_F10:
+		quitChan <- ""
+		return
+	case 0x1B: // Esc, or Alt+key
+		if l := memeditWindow.GetChar(); l != 0 {
+			k = -l
+		}
+	}
+	memeditSend(memeditInput{key: k, rows: rows})
+}
+
+// Pass input to the memory editor without waiting, since the debug goroutine
+// may be waiting for us to take a screen.  Input is dropped if the editor is
+// too busy to keep up.
+func memeditSend(in memeditInput) {
+	select {
+	case memeditInputChan <- in:
+	default:
+	}
+}
+
 // this routine moves the cursor back to the active input window
 // if we have done something that might have moved it.
 func fixCursor() {